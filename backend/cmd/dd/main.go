@@ -2,70 +2,200 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"time"
+	_ "unsafe" // for go:linkname
 
+	"backend/internal/admin"
+	"backend/internal/blob"
+	"backend/internal/compression"
+	"backend/internal/config"
+	"backend/internal/database"
 	"backend/internal/endpoint"
+	"backend/internal/fault"
+	"backend/internal/feature"
+	"backend/internal/job"
+	"backend/internal/live"
+	"backend/internal/moderation"
+	"backend/internal/post"
+	"backend/internal/preview"
+	"backend/internal/ratelimit"
+	"backend/internal/replica"
+	"backend/internal/seed"
+	"backend/internal/telemetry"
+	"backend/internal/tenant"
+	"backend/internal/webhook"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
 	"github.com/valkey-io/valkey-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	ddotel "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/opentelemetry"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	_ "modernc.org/sqlite"
 )
 
+// spanStartHook is called by the tracer with every span started from a context, including the SQL and Valkey spans of
+// the integrations. The tracer has no hook of its own, so orchestrion.yml adds the call when building with orchestrion.
+//
+//go:linkname spanStartHook __ddfeed_span_start_hook
+var spanStartHook = tagWorkspace
+
+// tagWorkspace tags span with the workspace of ctx, like the span processor of the OpenTelemetry build.
+func tagWorkspace(ctx context.Context, span tracer.Span) {
+	if id, ok := tenant.FromContext(ctx); ok {
+		span.SetTag(tenant.Tag, id)
+	}
+}
+
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	slog.SetDefault(slog.New(tenant.NewLogHandler(slog.NewJSONHandler(os.Stdout, nil))))
 
-	dataSourceName := os.Getenv("DDFEED_BACKEND_DATA_SOURCE_NAME")
-	if dataSourceName == "" {
-		slog.Error("DDFEED_BACKEND_DATA_SOURCE_NAME is required")
+	var seedOptions seed.Options
+	cfg, command, err := config.Run(os.Args, os.Stdout, map[string]func(*flag.FlagSet){
+		"seed": seedOptions.RegisterFlags,
+	})
+	if err != nil {
+		slog.Error("Invalid configuration", slog.Any("error", err))
+		os.Exit(2)
+	}
+	if command == "" {
 		return
 	}
-	var db *sqlx.DB
-	var dbConnectionError error
-	for i := range 10 {
-		db, dbConnectionError = sqlx.Connect("mysql", dataSourceName)
-		if dbConnectionError != nil {
-			slog.Debug("Failed to connect to database", slog.Any("error", dbConnectionError))
-			time.Sleep(time.Second * time.Duration(i))
-			continue
-		}
-		if db != nil {
-			break
+
+	// Spans started through the OpenTelemetry API (e.g. live events) are sent by the Datadog tracer.
+	otel.SetTracerProvider(ddotel.NewTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	telemetry.AddTagger(func(ctx context.Context, key string, value any) {
+		if span, ok := tracer.SpanFromContext(ctx); ok {
+			span.SetTag(key, value)
 		}
-	}
-	if db == nil {
-		slog.Error("Failed to connect to database", slog.Any("error", dbConnectionError))
+	})
+
+	db, err := connect(cfg.Database, cfg.Database.DataSourceName)
+	if err != nil {
+		slog.Error("Failed to connect to database", slog.Any("error", err))
 		return
 	}
 	defer db.Close()
+	if err := database.Migrate(ctx, db); err != nil {
+		slog.Error("Failed to migrate the database", slog.Any("error", err))
+		return
+	}
+	var replicaDBs []*sqlx.DB
+	for _, dsn := range cfg.Database.ReplicaDataSourceNames {
+		replicaDB, err := connect(cfg.Database, dsn)
+		if err != nil {
+			slog.Error("Failed to connect to database replica", slog.Any("error", err))
+			return
+		}
+		defer replicaDB.Close()
+		replicaDBs = append(replicaDBs, replicaDB)
+	}
 
 	vk, err := valkey.NewClient(valkey.ClientOption{
-		InitAddress: []string{"valkey:6379"},
+		InitAddress: []string{cfg.Valkey.Address},
 	})
 	if err != nil {
 		slog.Error("Failed to create Valkey client", slog.Any("error", err))
 		return
 	}
 
-	endpoint.Register(http.HandleFunc, db, vk)
+	if command == "seed" {
+		if err := seed.Run(ctx, db, vk, seedOptions); err != nil {
+			slog.Error("Failed to seed the database", slog.Any("error", err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	flags := feature.NewFlags(vk)
+	go flags.Run(ctx, 5*time.Second)
+	hub := live.NewHub(vk, cfg.Live.AllowedOrigins)
+	go hub.Run(ctx)
 
-	port := os.Getenv("DDFEED_BACKEND_PORT")
-	if port == "" {
-		port = "8080"
+	moderator, err := moderation.New(cfg.Moderation, http.DefaultClient)
+	if err != nil {
+		slog.Error("Invalid moderation configuration", slog.Any("error", err))
+		os.Exit(2)
+	}
+	blobs, err := blob.New(ctx, cfg.Attachments, http.DefaultClient)
+	if err != nil {
+		slog.Error("Failed to open attachment storage", slog.Any("error", err))
+		os.Exit(1)
 	}
-	slog.Info("Starting server on port " + port)
+	jobs := job.NewQueue(vk, cfg.Jobs.Workers)
+	quotas := tenant.NewQuotas(cfg.Workspaces)
+	replicas := replica.New(replicaDBs, cfg.Database.ReadYourWrites)
+	webhooks := webhook.NewDispatcher(db, jobs, webhook.NewClient(cfg.Webhooks), quotas)
+	// Orchestrion traces the requests of every http.Transport, so the preview client needs no wrapping.
+	previews := preview.New(cfg.Previews, vk, jobs, preview.NewClient(cfg.Previews))
+	store := post.NewStore(db, vk, flags, jobs, hub, post.Options{
+		CursorSecret:        []byte(cfg.Post.CursorSecret),
+		TrashRetention:      cfg.Post.TrashRetention,
+		Moderator:           moderator,
+		Webhooks:            webhooks,
+		Blobs:               blobs,
+		AttachmentSecret:    []byte(cfg.Attachments.URLSecret),
+		AttachmentURLExpiry: cfg.Attachments.URLExpiry,
+		MaxAttachmentSize:   cfg.Attachments.MaxSize,
+		MaxBodySize:         cfg.Post.MaxBodySize,
+		MaxImportSize:       cfg.Post.MaxImportSize,
+		Previews:            previews,
+		Quotas:              quotas,
+		Replicas:            replicas,
+	})
+	go store.RunPurger(ctx, time.Minute)
+	go jobs.Run(ctx)
+
+	faults := fault.NewInjector()
+	mux := http.NewServeMux()
+
+	endpoint.Register(mux.HandleFunc, db, store, hub, webhooks, ratelimit.New(vk), faults, compression.New(cfg.Compression), tenant.NewResolver(cfg.Workspaces), replicas, cfg.Post.TrashRetention, cfg.Post.MaxBodySize)
+
+	addr := fmt.Sprintf(":%d", cfg.Port)
+	slog.Info("Starting server on " + addr)
 	go func() {
-		if err := http.ListenAndServe(":"+port, http.DefaultServeMux); err != nil {
+		if err := http.ListenAndServe(addr, mux); err != nil {
 			slog.Error("Failed to start server", slog.Any("error", err))
 		}
 	}()
 
+	adminAddr := fmt.Sprintf(":%d", cfg.Admin.Port)
+	slog.Info("Starting admin server on " + adminAddr)
+	go func() {
+		if err := http.ListenAndServe(adminAddr, admin.Handler(cfg, vk, flags, faults, jobs, store, hub)); err != nil {
+			slog.Error("Failed to start admin server", slog.Any("error", err))
+		}
+	}()
+
 	<-ctx.Done()
 	slog.Info("Server stopped")
 }
+
+// connect connects to the database of dsn, trying cfg.ConnectAttempts times. The scheme of dsn chooses the driver.
+func connect(cfg config.Database, dsn string) (*sqlx.DB, error) {
+	driver, dsn, err := database.Driver(dsn)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cfg.ConnectAttempts {
+		var db *sqlx.DB
+		db, err = sqlx.Connect(driver, dsn)
+		if err == nil {
+			return db, nil
+		}
+		slog.Debug("Failed to connect to database", slog.Any("error", err))
+		time.Sleep(time.Second * time.Duration(i))
+	}
+	return nil, err
+}
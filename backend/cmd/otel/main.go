@@ -5,20 +5,38 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"regexp"
 	"strings"
 	"time"
 
+	"backend/internal/admin"
+	"backend/internal/blob"
+	"backend/internal/compression"
+	"backend/internal/config"
+	"backend/internal/database"
 	"backend/internal/endpoint"
+	"backend/internal/fault"
+	"backend/internal/feature"
+	"backend/internal/job"
+	"backend/internal/live"
+	"backend/internal/moderation"
+	"backend/internal/post"
+	"backend/internal/preview"
+	"backend/internal/ratelimit"
+	"backend/internal/replica"
+	"backend/internal/seed"
+	"backend/internal/tenant"
+	"backend/internal/webhook"
 
 	"github.com/XSAM/otelsql"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
 	"github.com/valkey-io/valkey-go"
 	"github.com/valkey-io/valkey-go/valkeyotel"
@@ -38,60 +56,116 @@ import (
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	oteltrace "go.opentelemetry.io/otel/trace"
+	_ "modernc.org/sqlite"
 )
 
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	slog.SetDefault(slog.New(tenant.NewLogHandler(slog.NewJSONHandler(os.Stdout, nil))))
+
+	var seedOptions seed.Options
+	cfg, command, err := config.Run(os.Args, os.Stdout, map[string]func(*flag.FlagSet){
+		"seed": seedOptions.RegisterFlags,
+	})
+	if err != nil {
+		slog.Error("Invalid configuration", slog.Any("error", err))
+		os.Exit(2)
+	}
+	if command == "" {
+		return
+	}
 
 	slog.Info("setting up OpenTelemetry SDK")
 	otelhttp.DefaultClient.Transport = otelhttp.NewTransport(transport{})
-	otelShutdown, err := setupOTelSDK(context.Background())
+	otelShutdown, err := setupOTelSDK(context.Background(), cfg.OTel)
 	if err != nil {
 		slog.Error("Failed to setup OpenTelemetry SDK", slog.Any("error", err))
 		return
 	}
 
-	dataSourceName := os.Getenv("DDFEED_BACKEND_DATA_SOURCE_NAME")
-	if dataSourceName == "" {
-		slog.Error("DDFEED_BACKEND_DATA_SOURCE_NAME is required")
+	dbx, err := connect(cfg.Database, cfg.Database.DataSourceName)
+	if err != nil {
+		slog.Error("Failed to connect to database", slog.Any("error", err))
 		return
 	}
-	var db *sql.DB
-	var dbx *sqlx.DB
-	var dbConnectionError error
-	for i := range 10 {
-		db, dbConnectionError = otelsql.Open("mysql", dataSourceName, otelsql.WithAttributes(semconv.DBSystemMySQL))
-		if dbConnectionError != nil {
-			slog.Debug("Failed to connect to database", slog.Any("error", dbConnectionError))
-			time.Sleep(time.Second * time.Duration(i))
-			continue
-		}
-		if db != nil {
-			dbx = sqlx.NewDb(db, "mysql")
-			break
-		}
-	}
-	if db == nil {
-		slog.Error("Failed to connect to database", slog.Any("error", dbConnectionError))
+	defer dbx.Close()
+	if err := database.Migrate(ctx, dbx); err != nil {
+		slog.Error("Failed to migrate the database", slog.Any("error", err))
 		return
 	}
-	defer db.Close()
-	if dbx == nil {
-		slog.Error("Failed to create sqlx database", slog.Any("error", dbConnectionError))
-		return
+	var replicaDBs []*sqlx.DB
+	for _, dsn := range cfg.Database.ReplicaDataSourceNames {
+		replicaDB, err := connect(cfg.Database, dsn, attribute.Bool("db.replica", true))
+		if err != nil {
+			slog.Error("Failed to connect to database replica", slog.Any("error", err))
+			return
+		}
+		defer replicaDB.Close()
+		replicaDBs = append(replicaDBs, replicaDB)
 	}
-	defer dbx.Close()
 
 	vk, err := valkeyotel.NewClient(valkey.ClientOption{
-		InitAddress: []string{"valkey:6379"},
+		InitAddress: []string{cfg.Valkey.Address},
 	})
 	if err != nil {
 		slog.Error("Failed to create Valkey client", slog.Any("error", err))
 		return
 	}
 
+	if command == "seed" {
+		if err := seed.Run(ctx, dbx, vk, seedOptions); err != nil {
+			slog.Error("Failed to seed the database", slog.Any("error", err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	flags := feature.NewFlags(vk)
+	go flags.Run(ctx, 5*time.Second)
+	hub := live.NewHub(vk, cfg.Live.AllowedOrigins)
+	go hub.Run(ctx)
+
+	moderator, err := moderation.New(cfg.Moderation, otelhttp.DefaultClient)
+	if err != nil {
+		slog.Error("Invalid moderation configuration", slog.Any("error", err))
+		os.Exit(2)
+	}
+	blobs, err := blob.New(ctx, cfg.Attachments, otelhttp.DefaultClient)
+	if err != nil {
+		slog.Error("Failed to open attachment storage", slog.Any("error", err))
+		os.Exit(1)
+	}
+	jobs := job.NewQueue(vk, cfg.Jobs.Workers)
+	quotas := tenant.NewQuotas(cfg.Workspaces)
+	replicas := replica.New(replicaDBs, cfg.Database.ReadYourWrites)
+	webhookClient := webhook.NewClient(cfg.Webhooks)
+	webhookClient.Transport = otelhttp.NewTransport(webhookClient.Transport)
+	webhooks := webhook.NewDispatcher(dbx, jobs, webhookClient, quotas)
+	previewClient := preview.NewClient(cfg.Previews)
+	previewClient.Transport = otelhttp.NewTransport(previewClient.Transport)
+	previews := preview.New(cfg.Previews, vk, jobs, previewClient)
+	store := post.NewStore(dbx, vk, flags, jobs, hub, post.Options{
+		CursorSecret:        []byte(cfg.Post.CursorSecret),
+		TrashRetention:      cfg.Post.TrashRetention,
+		Moderator:           moderator,
+		Webhooks:            webhooks,
+		Blobs:               blobs,
+		AttachmentSecret:    []byte(cfg.Attachments.URLSecret),
+		AttachmentURLExpiry: cfg.Attachments.URLExpiry,
+		MaxAttachmentSize:   cfg.Attachments.MaxSize,
+		MaxBodySize:         cfg.Post.MaxBodySize,
+		MaxImportSize:       cfg.Post.MaxImportSize,
+		Previews:            previews,
+		Quotas:              quotas,
+		Replicas:            replicas,
+	})
+	go store.RunPurger(ctx, time.Minute)
+	go jobs.Run(ctx)
+
+	faults := fault.NewInjector()
+	mux := http.NewServeMux()
+
 	endpoint.Register(func(pattern string, handler func(http.ResponseWriter, *http.Request)) {
 		route := pattern
 		parts := strings.Split(pattern, " ")
@@ -101,7 +175,7 @@ func main() {
 			// Datadog Resource Name: HTTP method + route
 			route = parts[1]
 		}
-		http.Handle(
+		mux.Handle(
 			pattern,
 			otelhttp.NewHandler(
 				otelhttp.WithRouteTag(
@@ -111,24 +185,56 @@ func main() {
 				pattern,
 			),
 		)
-	}, dbx, vk)
+	}, dbx, store, hub, webhooks, ratelimit.New(vk), faults, compression.New(cfg.Compression), tenant.NewResolver(cfg.Workspaces), replicas, cfg.Post.TrashRetention, cfg.Post.MaxBodySize)
 
-	port := os.Getenv("DDFEED_BACKEND_PORT")
-	if port == "" {
-		port = "8080"
-	}
-	slog.Info("Starting server on port " + port)
+	addr := fmt.Sprintf(":%d", cfg.Port)
+	slog.Info("Starting server on " + addr)
 	go func() {
-		if err := http.ListenAndServe(":"+port, http.DefaultServeMux); err != nil {
+		if err := http.ListenAndServe(addr, mux); err != nil {
 			slog.Error("Failed to start server", slog.Any("error", err))
 		}
 	}()
 
+	adminAddr := fmt.Sprintf(":%d", cfg.Admin.Port)
+	slog.Info("Starting admin server on " + adminAddr)
+	go func() {
+		if err := http.ListenAndServe(adminAddr, admin.Handler(cfg, vk, flags, faults, jobs, store, hub)); err != nil {
+			slog.Error("Failed to start admin server", slog.Any("error", err))
+		}
+	}()
+
 	<-ctx.Done()
 	slog.Info("Server stopped")
 	otelShutdown(context.Background())
 }
 
+// connect opens the database of dsn, trying cfg.ConnectAttempts times. The scheme of dsn chooses the driver, and
+// its spans get the attributes.
+func connect(cfg config.Database, dsn string, attrs ...attribute.KeyValue) (*sqlx.DB, error) {
+	driver, dsn, err := database.Driver(dsn)
+	if err != nil {
+		return nil, err
+	}
+	system := semconv.DBSystemMySQL
+	switch driver {
+	case database.Postgres:
+		system = semconv.DBSystemPostgreSQL
+	case database.SQLite:
+		system = semconv.DBSystemSqlite
+	}
+	attrs = append([]attribute.KeyValue{system}, attrs...)
+	for i := range cfg.ConnectAttempts {
+		var db *sql.DB
+		db, err = otelsql.Open(driver, dsn, otelsql.WithAttributes(attrs...))
+		if err == nil {
+			return sqlx.NewDb(db, driver), nil
+		}
+		slog.Debug("Failed to connect to database", slog.Any("error", err))
+		time.Sleep(time.Second * time.Duration(i))
+	}
+	return nil, err
+}
+
 type transport struct{}
 
 func (transport) RoundTrip(r *http.Request) (*http.Response, error) {
@@ -140,9 +246,23 @@ func (transport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return http.DefaultTransport.RoundTrip(r)
 }
 
+// workspaceProcessor tags every span started in a workspace with it, including the SQL and Valkey spans of the
+// instrumentation libraries.
+type workspaceProcessor struct{}
+
+func (workspaceProcessor) OnStart(ctx context.Context, s trace.ReadWriteSpan) {
+	if id, ok := tenant.FromContext(ctx); ok {
+		s.SetAttributes(attribute.String(tenant.Tag, id))
+	}
+}
+
+func (workspaceProcessor) OnEnd(trace.ReadOnlySpan)         {}
+func (workspaceProcessor) Shutdown(context.Context) error   { return nil }
+func (workspaceProcessor) ForceFlush(context.Context) error { return nil }
+
 // setupOTelSDK bootstraps the OpenTelemetry pipeline.
 // If it does not return an error, make sure to call shutdown for proper cleanup.
-func setupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, err error) {
+func setupOTelSDK(ctx context.Context, cfg config.OTel) (shutdown func(context.Context) error, err error) {
 	var shutdownFuncs []func(context.Context) error
 
 	// shutdown calls cleanup functions registered via shutdownFuncs.
@@ -167,7 +287,7 @@ func setupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, er
 	otel.SetTextMapPropagator(prop)
 
 	// Set up trace provider.
-	tracerProvider, err := newTraceProvider()
+	tracerProvider, err := newTraceProvider(cfg)
 	if err != nil {
 		handleErr(err)
 		return
@@ -176,7 +296,7 @@ func setupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, er
 	otel.SetTracerProvider(tracerProvider)
 
 	// Set up meter provider.
-	meterProvider, err := newMeterProvider()
+	meterProvider, err := newMeterProvider(cfg)
 	if err != nil {
 		handleErr(err)
 		return
@@ -190,7 +310,7 @@ func setupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, er
 	}
 
 	// Set up logger provider.
-	loggerProvider, err := newLoggerProvider()
+	loggerProvider, err := newLoggerProvider(cfg)
 	if err != nil {
 		handleErr(err)
 		return
@@ -208,18 +328,18 @@ func newPropagator() propagation.TextMapPropagator {
 	)
 }
 
-func newTraceProvider() (*trace.TracerProvider, error) {
+func newTraceProvider(cfg config.OTel) (*trace.TracerProvider, error) {
 	var opts []trace.TracerProviderOption
 	traceExporter, err := otlptracegrpc.New(context.Background(),
 		otlptracegrpc.WithInsecure(),
-		otlptracegrpc.WithEndpoint(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")),
+		otlptracegrpc.WithEndpoint(cfg.ExporterEndpoint),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("creating grpc trace exporter: %w", err)
 	}
 	opts = append(opts, trace.WithSyncer(traceExporter))
 
-	if v := os.Getenv("OTEL_TRACE_DEBUG"); v == "true" {
+	if cfg.TraceDebug {
 		slog.Info("debug tracing enabled, adding stdout printer")
 		stdoutPrinter, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
 		if err != nil {
@@ -245,14 +365,15 @@ func newTraceProvider() (*trace.TracerProvider, error) {
 		return nil, fmt.Errorf("merging resource: %w", err)
 	}
 	opts = append(opts, trace.WithResource(r))
+	opts = append(opts, trace.WithSpanProcessor(workspaceProcessor{}))
 	slog.Info("trace provider created successfully")
 	return trace.NewTracerProvider(opts...), nil
 }
 
-func newMeterProvider() (*metric.MeterProvider, error) {
+func newMeterProvider(cfg config.OTel) (*metric.MeterProvider, error) {
 	metricExporter, err := otlpmetricgrpc.New(context.Background(),
 		otlpmetricgrpc.WithInsecure(),
-		otlpmetricgrpc.WithEndpoint(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")),
+		otlpmetricgrpc.WithEndpoint(cfg.ExporterEndpoint),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create metric exporter: %w", err)
@@ -275,10 +396,10 @@ func newMeterProvider() (*metric.MeterProvider, error) {
 	return meterProvider, nil
 }
 
-func newLoggerProvider() (*log.LoggerProvider, error) {
+func newLoggerProvider(cfg config.OTel) (*log.LoggerProvider, error) {
 	logExporter, err := otlploggrpc.New(context.Background(),
 		otlploggrpc.WithInsecure(),
-		otlploggrpc.WithEndpoint(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")),
+		otlploggrpc.WithEndpoint(cfg.ExporterEndpoint),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create log exporter: %w", err)
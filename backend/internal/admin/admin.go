@@ -0,0 +1,156 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"backend/internal/config"
+	"backend/internal/fault"
+	"backend/internal/feature"
+	"backend/internal/job"
+	"backend/internal/live"
+	"backend/internal/post"
+	"backend/internal/tenant"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// Handler serves the diagnostics and the moderation queue of the backend. It listens on its own port, which the
+// gateway does not expose.
+func Handler(cfg config.Config, vk valkey.Client, flags *feature.Flags, faults *fault.Injector, jobs *job.Queue, store *post.Store, hub *live.Hub) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /buildinfo", buildInfo())
+	mux.HandleFunc("GET /config", configDump(cfg))
+	mux.HandleFunc("GET /cache/stats", cacheStats(vk))
+	mux.HandleFunc("GET /flags", feature.ListHandler(flags))
+	mux.HandleFunc("PUT /flags/{name}", feature.SetHandler(flags))
+	mux.HandleFunc("DELETE /flags/{name}", feature.ResetHandler(flags))
+	faultHandler := fault.Handler(faults)
+	mux.HandleFunc("GET /faults", faultHandler)
+	mux.HandleFunc("PUT /faults", faultHandler)
+	mux.HandleFunc("GET /jobs", job.StatsHandler(jobs))
+	mux.HandleFunc("GET /jobs/dead", job.DeadHandler(jobs))
+	mux.HandleFunc("POST /jobs/dead/retry", job.RetryDeadHandler(jobs))
+	mux.HandleFunc("GET /moderation", inWorkspace(post.ModerationQueue(store)))
+	mux.HandleFunc("POST /moderation/{kind}/{id}", inWorkspace(post.Review(store, hub)))
+	return mux
+}
+
+// inWorkspace runs next in the workspace named by the workspace query parameter, or else the default one.
+func inWorkspace(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("workspace")
+		if id == "" {
+			id = tenant.Default
+		}
+		if err := tenant.Validate(id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next(w, r.WithContext(tenant.With(r.Context(), id)))
+	}
+}
+
+func buildInfo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			http.Error(w, "no build info", http.StatusNotFound)
+			return
+		}
+		settings := make(map[string]string, len(info.Settings))
+		for _, s := range info.Settings {
+			settings[s.Key] = s.Value
+		}
+		deps := make([]string, len(info.Deps))
+		for i, dep := range info.Deps {
+			deps[i] = dep.Path + "@" + dep.Version
+		}
+		response := struct {
+			GoVersion string            `json:"go_version"`
+			Path      string            `json:"path"`
+			Settings  map[string]string `json:"settings"`
+			Deps      []string          `json:"deps"`
+		}{
+			GoVersion: info.GoVersion,
+			Path:      info.Path,
+			Settings:  settings,
+			Deps:      deps,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func configDump(cfg config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		if err := cfg.Print(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// cacheStatsFields are the INFO fields describing how well Valkey serves as a cache.
+var cacheStatsFields = []string{
+	"keyspace_hits",
+	"keyspace_misses",
+	"expired_keys",
+	"evicted_keys",
+	"used_memory",
+	"maxmemory",
+	"connected_clients",
+	"total_commands_processed",
+}
+
+func cacheStats(vk valkey.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, err := vk.Do(r.Context(), vk.B().Info().Section("stats", "memory", "clients").Build()).ToString()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		keys, err := vk.Do(r.Context(), vk.B().Dbsize().Build()).AsInt64()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		values := make(map[string]string)
+		for _, line := range strings.Split(info, "\r\n") {
+			if k, v, ok := strings.Cut(line, ":"); ok {
+				values[k] = v
+			}
+		}
+		stats := make(map[string]int64, len(cacheStatsFields))
+		for _, field := range cacheStatsFields {
+			if n, err := strconv.ParseInt(values[field], 10, 64); err == nil {
+				stats[field] = n
+			}
+		}
+		var hitRate float64
+		if total := stats["keyspace_hits"] + stats["keyspace_misses"]; total > 0 {
+			hitRate = float64(stats["keyspace_hits"]) / float64(total)
+		}
+		response := struct {
+			Keys    int64            `json:"keys"`
+			HitRate float64          `json:"hit_rate"`
+			Stats   map[string]int64 `json:"stats"`
+		}{
+			Keys:    keys,
+			HitRate: hitRate,
+			Stats:   stats,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
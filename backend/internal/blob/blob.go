@@ -0,0 +1,34 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"backend/internal/config"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps files under slash-separated keys such as posts/<post id>/<attachment id>.
+type Store interface {
+	// Put writes size bytes from r under key, replacing any previous file.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get returns the file under key and its size, or ErrNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, int64, error)
+	// Delete removes the file under key. Deleting a missing file is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// New returns the storage chosen by the configuration. client calls S3.
+func New(ctx context.Context, cfg config.Attachments, client *http.Client) (Store, error) {
+	switch cfg.Storage {
+	case "local":
+		return NewLocal(cfg.Dir)
+	case "s3":
+		return NewS3(ctx, cfg.S3, client)
+	}
+	return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+}
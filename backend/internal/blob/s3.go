@@ -0,0 +1,93 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"backend/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// S3 keeps files in a bucket of S3 or of an S3-compatible service such as MinIO.
+type S3 struct {
+	client *s3.Client
+	bucket string
+}
+
+// NewS3 returns a storage in the bucket, creating the bucket if it does not exist.
+func NewS3(ctx context.Context, cfg config.S3, client *http.Client) (*S3, error) {
+	opts := s3.Options{
+		Region:     cfg.Region,
+		HTTPClient: client,
+	}
+	if cfg.AccessKeyID != "" {
+		opts.Credentials = aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: cfg.AccessKeyID, SecretAccessKey: cfg.SecretAccessKey, Source: "ddfeed configuration"}, nil
+		})
+	}
+	if cfg.Endpoint != "" {
+		opts.EndpointResolver = s3.EndpointResolverFromURL(cfg.Endpoint)
+		// S3-compatible services seldom resolve bucket subdomains.
+		opts.UsePathStyle = true
+	}
+	s := &S3{client: s3.New(opts), bucket: cfg.Bucket}
+
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchBucket") {
+		_, err = s.client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(s.bucket)})
+		var owned *types.BucketAlreadyOwnedByYou
+		if errors.As(err, &owned) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bucket %s: %w", s.bucket, err)
+	}
+	return s, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          r,
+		ContentLength: size,
+		ContentType:   aws.String(contentType),
+	}, s3.WithAPIOptions(
+		// Signing the payload needs to read it twice, which a plain io.Reader does not allow.
+		v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware,
+	))
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return out.Body, out.ContentLength, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
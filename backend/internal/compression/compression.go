@@ -0,0 +1,294 @@
+package compression
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"backend/internal/config"
+	"backend/internal/telemetry"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The encodings, in order of preference when the client accepts several equally.
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+var encodings = []string{encodingZstd, encodingGzip}
+
+// encoder is what gzip.Writer and zstd.Encoder have in common.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Compressor compresses responses with the encoding negotiated from Accept-Encoding.
+// The methods of a nil Compressor do nothing, which is how compression is disabled.
+type Compressor struct {
+	minSize int
+	pools   map[string]*sync.Pool
+}
+
+// New returns nil if compression is disabled.
+func New(cfg config.Compression) *Compressor {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Compressor{
+		minSize: cfg.MinSize,
+		pools: map[string]*sync.Pool{
+			encodingGzip: {New: func() any {
+				return gzip.NewWriter(nil)
+			}},
+			encodingZstd: {New: func() any {
+				// The default window of 8 MiB is the largest browsers decode.
+				enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+				return enc
+			}},
+		},
+	}
+}
+
+// Wrap compresses the responses of next that are at least the minimum size, or that are flushed, which is what
+// streaming handlers do.
+func (c *Compressor) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		// WebSocket upgrades take over the connection, and HEAD responses have no body.
+		if r.Header.Get("Upgrade") != "" || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next(w, r)
+			return
+		}
+		cw := &writer{ResponseWriter: w, c: c, encoding: encoding}
+		// The ETags of compressed responses carry the encoding, which the handlers do not know about.
+		if v := r.Header.Get("If-None-Match"); v != "" {
+			stripped := stripETagSuffixes(v)
+			cw.cachedCompressed = stripped != v
+			r.Header.Set("If-None-Match", stripped)
+		}
+		if v := r.Header.Get("If-Match"); v != "" {
+			r.Header.Set("If-Match", stripETagSuffixes(v))
+		}
+		defer cw.close(r)
+		next(cw, r)
+	}
+}
+
+// negotiate returns the preferred encoding among those the Accept-Encoding header accepts, or nothing.
+func negotiate(header string) string {
+	qualities := map[string]float64{}
+	wildcard := 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(key, "q") {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		qualities[name] = q
+	}
+	var best string
+	var bestQ float64
+	for _, encoding := range encodings {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+func etagSuffix(encoding string) string {
+	return "-" + encoding
+}
+
+// stripETagSuffixes removes the encoding that was added to the ETags of a conditional header.
+func stripETagSuffixes(header string) string {
+	for _, encoding := range encodings {
+		header = strings.ReplaceAll(header, etagSuffix(encoding)+`"`, `"`)
+	}
+	return header
+}
+
+// compressible reports whether a media type is text, which compresses, rather than already compressed data.
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "text/"), strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/vnd.msgpack", "application/javascript",
+		"application/xml", "application/graphql-response+json":
+		return true
+	}
+	return false
+}
+
+// writer holds the response back until it knows whether to compress it: once minSize bytes were written, the
+// handler flushed or it returned.
+type writer struct {
+	http.ResponseWriter
+	c        *Compressor
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	enc      encoder
+	// cachedCompressed is set when the client has a compressed response in its cache, which a 304 refers to.
+	cachedCompressed bool
+	// raw and sent count the bytes written by the handler and to the client.
+	raw, sent int
+}
+
+func (w *writer) WriteHeader(status int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		w.decide(false)
+	}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.raw += len(p)
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.c.minSize {
+			return len(p), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return w.write(p)
+}
+
+// Flush sends what was written so far, compressing it if the response can be.
+func (w *writer) Flush() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		if w.decide(true) != nil {
+			return
+		}
+	}
+	if w.enc != nil && w.enc.Flush() != nil {
+		return
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// decide writes the header, compressed if compress is true and the response can be, and then the buffer.
+func (w *writer) decide(compress bool) error {
+	w.decided = true
+	buf := w.buf
+	w.buf = nil
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(buf) > 0 {
+		// net/http would sniff the compressed bytes.
+		h.Set("Content-Type", http.DetectContentType(buf))
+	}
+	if compress && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" && compressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		w.suffixETag()
+		w.enc = w.c.pools[w.encoding].Get().(encoder)
+		w.enc.Reset(counter{w})
+	} else if w.status == http.StatusNotModified && w.cachedCompressed {
+		w.suffixETag()
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.write(buf)
+	return err
+}
+
+// suffixETag adds the encoding to the ETag, since a compressed response is another representation.
+func (w *writer) suffixETag() {
+	if etag := w.Header().Get("ETag"); strings.HasSuffix(etag, `"`) {
+		w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+etagSuffix(w.encoding)+`"`)
+	}
+}
+
+func (w *writer) write(p []byte) (int, error) {
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.sent += n
+	return n, err
+}
+
+// close sends what the handler left in the buffer, or the end of the compressed stream, and tags the span with
+// the sizes of the response.
+func (w *writer) close(r *http.Request) {
+	if !w.decided {
+		if w.status == 0 {
+			// The handler wrote nothing, net/http sends a 200 without a body.
+			return
+		}
+		w.decide(false)
+	}
+	if w.enc == nil {
+		return
+	}
+	w.enc.Close()
+	w.enc.Reset(nil)
+	w.c.pools[w.encoding].Put(w.enc)
+	telemetry.SetTag(r.Context(), "http.response.content_encoding", w.encoding)
+	telemetry.SetTag(r.Context(), "http.response.body.uncompressed_size", w.raw)
+	telemetry.SetTag(r.Context(), "http.response.body.size", w.sent)
+}
+
+// counter counts the compressed bytes sent by a writer.
+type counter struct {
+	w *writer
+}
+
+func (c counter) Write(p []byte) (int, error) {
+	n, err := c.w.ResponseWriter.Write(p)
+	c.w.sent += n
+	return n, err
+}
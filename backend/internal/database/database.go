@@ -0,0 +1,73 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Names of the database/sql drivers of the databases the backend runs against.
+const (
+	MySQL    = "mysql"
+	Postgres = "pgx"
+	SQLite   = "sqlite"
+)
+
+// sqliteParams are the query parameters of the DSNs given to the SQLite driver.
+// Transactions take the write lock when they begin, since SQLite fails rather than waits when a transaction that
+// read has to write while another one writes.
+const sqliteParams = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite&_txlock=immediate"
+
+// Driver returns the database/sql driver of dsn and the DSN to give it.
+// postgres:// and postgresql:// URLs go to pgx, and sqlite:// URLs to modernc.org/sqlite with the path of the database
+// file after the scheme, e.g. sqlite://ddfeed.db or sqlite:///var/lib/ddfeed/ddfeed.db. Anything else is a
+// go-sql-driver/mysql DSN, optionally prefixed with mysql://, which the driver does not take.
+func Driver(dsn string) (string, string, error) {
+	scheme, rest, ok := strings.Cut(dsn, "://")
+	if !ok || strings.ContainsAny(scheme, ":@(/") {
+		return MySQL, dsn, nil
+	}
+	switch scheme {
+	case "mysql":
+		return MySQL, rest, nil
+	case "postgres", "postgresql":
+		return Postgres, dsn, nil
+	case "sqlite":
+		path, query, _ := strings.Cut(rest, "?")
+		if path == "" {
+			return "", "", fmt.Errorf("no database file in %q", dsn)
+		}
+		params := sqliteParams
+		if query != "" {
+			params += "&" + query
+		}
+		return SQLite, path + "?" + params, nil
+	}
+	return "", "", fmt.Errorf("unsupported database scheme %q", scheme)
+}
+
+// InsertID runs the INSERT query with e and returns the ID of the inserted row.
+// PostgreSQL has no last insert ID, so the query returns the ID there instead.
+func InsertID(ctx context.Context, e sqlx.ExtContext, query string, args ...any) (int64, error) {
+	if e.DriverName() == Postgres {
+		var id int64
+		err := sqlx.GetContext(ctx, e, &id, e.Rebind(query+" RETURNING id"), args...)
+		return id, err
+	}
+	result, err := e.ExecContext(ctx, e.Rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// ForUpdate returns the clause locking the rows a SELECT of a transaction of e reads.
+// SQLite has no row locks, but its transactions already hold the lock of the whole database.
+func ForUpdate(e sqlx.ExtContext) string {
+	if e.DriverName() == SQLite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
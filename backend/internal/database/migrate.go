@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+// migrationDirs are the directories of migrations of each driver. The MySQL schema is created by mysql/init.sh.
+var migrationDirs = map[string]string{
+	Postgres: "migrations/postgres",
+	SQLite:   "migrations/sqlite",
+}
+
+// Migrate runs the migrations of the driver of db that did not run yet, in the order of their file names, and
+// records them in schema_migrations.
+func Migrate(ctx context.Context, db *sqlx.DB) error {
+	dir, ok := migrationDirs[db.DriverName()]
+	if !ok {
+		return nil
+	}
+	names, err := fs.Glob(migrations, dir+"/*.sql")
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version VARCHAR(255) PRIMARY KEY, applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP)"); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	for _, name := range names {
+		if err := migrate(ctx, db, name); err != nil {
+			return fmt.Errorf("migration %s: %w", path.Base(name), err)
+		}
+	}
+	return nil
+}
+
+// migrate runs the migration in a transaction unless it already ran.
+func migrate(ctx context.Context, db *sqlx.DB, name string) error {
+	version := strings.TrimSuffix(path.Base(name), ".sql")
+	script, err := migrations.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Backends starting together wait here for the first one to migrate, and then find the migration done.
+	// The transactions of SQLite already lock the database when they begin.
+	if db.DriverName() != SQLite {
+		if _, err := tx.ExecContext(ctx, "LOCK TABLE schema_migrations IN EXCLUSIVE MODE"); err != nil {
+			return err
+		}
+	}
+	var done bool
+	if err := tx.GetContext(ctx, &done, tx.Rebind("SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = ?)"), version); err != nil {
+		return err
+	}
+	if done {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind("INSERT INTO schema_migrations (version) VALUES (?)"), version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
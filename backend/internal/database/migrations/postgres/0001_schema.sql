@@ -0,0 +1,95 @@
+-- The tables of mysql/init.sh.
+CREATE TABLE post (
+    id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    public_id CHAR(26) NOT NULL,
+    workspace_id VARCHAR(32) NOT NULL DEFAULT 'default',
+    body TEXT,
+    created_at TIMESTAMPTZ(0) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ(6) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    edited_at TIMESTAMPTZ(0) NULL DEFAULT NULL,
+    deleted_at TIMESTAMPTZ(0) NULL DEFAULT NULL,
+    moderation VARCHAR(8) NOT NULL DEFAULT 'allow',
+    moderation_reasons TEXT NULL,
+    CONSTRAINT idx_post_public_id UNIQUE (public_id)
+);
+CREATE INDEX idx_post_deleted_at ON post (deleted_at);
+CREATE INDEX idx_post_workspace_id ON post (workspace_id, deleted_at, id);
+CREATE INDEX idx_post_moderation ON post (moderation);
+
+CREATE TABLE comment (
+    id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    public_id CHAR(26) NOT NULL,
+    workspace_id VARCHAR(32) NOT NULL DEFAULT 'default',
+    body TEXT,
+    post_id INTEGER REFERENCES post (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ(0) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ(0) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    moderation VARCHAR(8) NOT NULL DEFAULT 'allow',
+    moderation_reasons TEXT NULL,
+    CONSTRAINT idx_comment_public_id UNIQUE (public_id)
+);
+CREATE INDEX idx_comment_post_id ON comment (post_id);
+CREATE INDEX idx_comment_moderation ON comment (moderation);
+CREATE INDEX idx_comment_workspace_id ON comment (workspace_id);
+
+CREATE TABLE post_revision (
+    id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    post_id INTEGER NOT NULL REFERENCES post (id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    body TEXT,
+    created_at TIMESTAMPTZ(0) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT idx_post_revision_post_id_revision UNIQUE (post_id, revision)
+);
+
+CREATE TABLE attachment (
+    id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    public_id CHAR(26) NOT NULL,
+    post_id INTEGER NOT NULL REFERENCES post (id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    blob_key VARCHAR(255) NOT NULL,
+    thumbnail_key VARCHAR(255) NULL,
+    width INTEGER NULL,
+    height INTEGER NULL,
+    created_at TIMESTAMPTZ(0) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT idx_attachment_public_id UNIQUE (public_id)
+);
+CREATE INDEX idx_attachment_post_id ON attachment (post_id);
+
+CREATE TABLE webhook (
+    id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    public_id CHAR(26) NOT NULL,
+    workspace_id VARCHAR(32) NOT NULL DEFAULT 'default',
+    url VARCHAR(2048) NOT NULL,
+    events VARCHAR(255) NOT NULL,
+    secret CHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ(0) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT idx_webhook_public_id UNIQUE (public_id)
+);
+CREATE INDEX idx_webhook_workspace_id ON webhook (workspace_id);
+
+CREATE TABLE webhook_delivery (
+    id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    webhook_id INTEGER NOT NULL REFERENCES webhook (id) ON DELETE CASCADE,
+    delivery_id VARCHAR(40) NOT NULL,
+    event VARCHAR(32) NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER NULL,
+    error TEXT NULL,
+    duration_ms INTEGER NOT NULL,
+    created_at TIMESTAMPTZ(0) NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_webhook_delivery_webhook_id ON webhook_delivery (webhook_id, id);
+
+-- MySQL sets updated_at with ON UPDATE CURRENT_TIMESTAMP, when an update changes the row.
+CREATE FUNCTION set_updated_at() RETURNS trigger AS $$
+BEGIN
+    IF NEW IS DISTINCT FROM OLD THEN
+        NEW.updated_at = statement_timestamp();
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER post_updated_at BEFORE UPDATE ON post FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+CREATE TRIGGER comment_updated_at BEFORE UPDATE ON comment FOR EACH ROW EXECUTE FUNCTION set_updated_at();
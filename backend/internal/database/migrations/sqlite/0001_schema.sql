@@ -0,0 +1,100 @@
+-- The tables of mysql/init.sh. AUTOINCREMENT keeps the IDs of deleted rows from being reused, which the ETags of
+-- posts rely on for comments. Times are UTC text, which the driver reads back from the TIMESTAMP columns.
+CREATE TABLE post (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    public_id CHAR(26) NOT NULL,
+    workspace_id VARCHAR(32) NOT NULL DEFAULT 'default',
+    body TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    edited_at TIMESTAMP NULL DEFAULT NULL,
+    deleted_at TIMESTAMP NULL DEFAULT NULL,
+    moderation VARCHAR(8) NOT NULL DEFAULT 'allow',
+    moderation_reasons TEXT NULL
+);
+CREATE UNIQUE INDEX idx_post_public_id ON post (public_id);
+CREATE INDEX idx_post_deleted_at ON post (deleted_at);
+CREATE INDEX idx_post_workspace_id ON post (workspace_id, deleted_at, id);
+CREATE INDEX idx_post_moderation ON post (moderation);
+
+CREATE TABLE comment (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    public_id CHAR(26) NOT NULL,
+    workspace_id VARCHAR(32) NOT NULL DEFAULT 'default',
+    body TEXT,
+    post_id INTEGER REFERENCES post (id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    moderation VARCHAR(8) NOT NULL DEFAULT 'allow',
+    moderation_reasons TEXT NULL
+);
+CREATE UNIQUE INDEX idx_comment_public_id ON comment (public_id);
+CREATE INDEX idx_comment_post_id ON comment (post_id);
+CREATE INDEX idx_comment_moderation ON comment (moderation);
+CREATE INDEX idx_comment_workspace_id ON comment (workspace_id);
+
+CREATE TABLE post_revision (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_id INTEGER NOT NULL REFERENCES post (id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    body TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX idx_post_revision_post_id_revision ON post_revision (post_id, revision);
+
+CREATE TABLE attachment (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    public_id CHAR(26) NOT NULL,
+    post_id INTEGER NOT NULL REFERENCES post (id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    blob_key VARCHAR(255) NOT NULL,
+    thumbnail_key VARCHAR(255) NULL,
+    width INTEGER NULL,
+    height INTEGER NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX idx_attachment_public_id ON attachment (public_id);
+CREATE INDEX idx_attachment_post_id ON attachment (post_id);
+
+CREATE TABLE webhook (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    public_id CHAR(26) NOT NULL,
+    workspace_id VARCHAR(32) NOT NULL DEFAULT 'default',
+    url VARCHAR(2048) NOT NULL,
+    events VARCHAR(255) NOT NULL,
+    secret CHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX idx_webhook_public_id ON webhook (public_id);
+CREATE INDEX idx_webhook_workspace_id ON webhook (workspace_id);
+
+CREATE TABLE webhook_delivery (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INTEGER NOT NULL REFERENCES webhook (id) ON DELETE CASCADE,
+    delivery_id VARCHAR(40) NOT NULL,
+    event VARCHAR(32) NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER NULL,
+    error TEXT NULL,
+    duration_ms INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_webhook_delivery_webhook_id ON webhook_delivery (webhook_id, id);
+
+-- MySQL sets updated_at with ON UPDATE CURRENT_TIMESTAMP, when an update changes the row.
+CREATE TRIGGER post_updated_at AFTER UPDATE ON post FOR EACH ROW
+WHEN NEW.updated_at IS OLD.updated_at
+    AND (NEW.public_id, NEW.workspace_id, NEW.body, NEW.created_at, NEW.edited_at, NEW.deleted_at, NEW.moderation, NEW.moderation_reasons)
+    IS NOT (OLD.public_id, OLD.workspace_id, OLD.body, OLD.created_at, OLD.edited_at, OLD.deleted_at, OLD.moderation, OLD.moderation_reasons)
+BEGIN
+    UPDATE post SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE id = NEW.id;
+END;
+CREATE TRIGGER comment_updated_at AFTER UPDATE ON comment FOR EACH ROW
+WHEN NEW.updated_at IS OLD.updated_at
+    AND (NEW.public_id, NEW.workspace_id, NEW.body, NEW.post_id, NEW.created_at, NEW.moderation, NEW.moderation_reasons)
+    IS NOT (OLD.public_id, OLD.workspace_id, OLD.body, OLD.post_id, OLD.created_at, OLD.moderation, OLD.moderation_reasons)
+BEGIN
+    UPDATE comment SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
@@ -0,0 +1,152 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// contextLines is the number of unchanged lines shown around each change, as in `diff -u`.
+const contextLines = 3
+
+// maxLCSCells bounds the table of the longest common subsequence, whose size is the product of the numbers of
+// changed lines. Longer changes are shown as removing all the old lines and adding all the new ones.
+const maxLCSCells = 1 << 20
+
+type edit struct {
+	kind byte // ' ' unchanged, '-' removed, '+' added
+	text string
+	// aLine and bLine are the 0-based line numbers in each text where the edit applies.
+	aLine, bLine int
+}
+
+// Unified returns the line-based unified diff turning from into to, or "" when they are equal.
+// It computes a longest common subsequence of the lines between the common prefix and suffix, up to maxLCSCells.
+func Unified(fromName, toName, from, to string) string {
+	edits := lineEdits(splitLines(from), splitLines(to))
+	var sb strings.Builder
+	for i := 0; i < len(edits); i++ {
+		if edits[i].kind == ' ' {
+			continue
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		// Merge changes separated by few enough unchanged lines that their contexts would overlap.
+		last := i
+		for j := i + 1; j < len(edits); j++ {
+			if edits[j].kind != ' ' {
+				last = j
+			} else if j-last > 2*contextLines {
+				break
+			}
+		}
+		start := max(i-contextLines, 0)
+		end := min(last+1+contextLines, len(edits))
+		writeHunk(&sb, edits[start:end])
+		i = end - 1
+	}
+	return sb.String()
+}
+
+func writeHunk(sb *strings.Builder, hunk []edit) {
+	aStart, bStart := hunk[0].aLine, hunk[0].bLine
+	var aCount, bCount int
+	for _, e := range hunk {
+		if e.kind != '+' {
+			aCount++
+		}
+		if e.kind != '-' {
+			bCount++
+		}
+	}
+	// Empty ranges point at the line before, non-empty ones at their first line (1-based).
+	if aCount > 0 {
+		aStart++
+	}
+	if bCount > 0 {
+		bStart++
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+	for _, e := range hunk {
+		sb.WriteByte(e.kind)
+		sb.WriteString(e.text)
+		sb.WriteByte('\n')
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+func lineEdits(a, b []string) []edit {
+	edits := make([]edit, 0, len(a)+len(b))
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		edits = append(edits, edit{kind: ' ', text: a[prefix], aLine: prefix, bLine: prefix})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	edits = append(edits, middleEdits(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], prefix, prefix)...)
+	for k := suffix; k > 0; k-- {
+		i, j := len(a)-k, len(b)-k
+		edits = append(edits, edit{kind: ' ', text: a[i], aLine: i, bLine: j})
+	}
+	return edits
+}
+
+// middleEdits returns the edits turning a into b, which start at the lines aStart and bStart of their texts.
+func middleEdits(a, b []string, aStart, bStart int) []edit {
+	edits := make([]edit, 0, len(a)+len(b))
+	if (len(a)+1)*(len(b)+1) > maxLCSCells {
+		for i, line := range a {
+			edits = append(edits, edit{kind: '-', text: line, aLine: aStart + i, bLine: bStart})
+		}
+		for j, line := range b {
+			edits = append(edits, edit{kind: '+', text: line, aLine: aStart + len(a), bLine: bStart + j})
+		}
+		return edits
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{kind: ' ', text: a[i], aLine: aStart + i, bLine: bStart + j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{kind: '-', text: a[i], aLine: aStart + i, bLine: bStart + j})
+			i++
+		default:
+			edits = append(edits, edit{kind: '+', text: b[j], aLine: aStart + i, bLine: bStart + j})
+			j++
+		}
+	}
+	return edits
+}
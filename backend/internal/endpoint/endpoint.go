@@ -1,24 +1,106 @@
 package endpoint
 
 import (
+	"backend/internal/compression"
+	"backend/internal/fault"
+	"backend/internal/graph"
 	"backend/internal/healthcheck"
+	"backend/internal/live"
 	"backend/internal/post"
+	"backend/internal/ratelimit"
+	"backend/internal/replica"
+	"backend/internal/tenant"
+	"backend/internal/webhook"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/valkey-io/valkey-go"
 )
 
 type RegisterFunc func(pattern string, handler func(http.ResponseWriter, *http.Request))
 
-func Register(register RegisterFunc, db *sqlx.DB, vk valkey.Client) {
+// Limits of the routes writing to the database. Reads are cached and left unlimited.
+var (
+	createPostRule = ratelimit.Rule{Limit: 10, Period: time.Minute}
+	writePostRule  = ratelimit.Rule{Limit: 30, Period: time.Minute}
+	commentRule    = ratelimit.Rule{Limit: 30, Period: time.Minute}
+	graphQLRule    = ratelimit.Rule{Limit: 60, Period: time.Minute}
+	importRule     = ratelimit.Rule{Limit: 5, Period: time.Minute}
+	batchPostRule  = ratelimit.Rule{Limit: 5, Period: time.Minute}
+	webhookRule    = ratelimit.Rule{Limit: 10, Period: time.Minute}
+)
+
+func Register(register RegisterFunc, db *sqlx.DB, store *post.Store, hub *live.Hub, webhooks *webhook.Dispatcher, limiter *ratelimit.Limiter, faults *fault.Injector, compressor *compression.Compressor, resolver *tenant.Resolver, replicas *replica.Pool, trashRetention time.Duration, maxBodySize int64) {
+	register = withCompression(register, compressor)
+	register = withFaults(register, faults)
+	register = withReplicas(register, replicas)
+	register = withWorkspace(register, resolver)
 	register("GET /api/v1/liveness", healthcheck.LivenessHandler())
 	register("GET /api/v1/readiness", healthcheck.ReadinessHandler(db))
-	register("POST /ui/v1/posts", post.Create(db, vk))
-	register("GET /ui/v1/posts", post.List(db, vk))
-	register("GET /ui/v1/posts/{id}", post.GetByID(db, vk))
-	register("DELETE /ui/v1/posts/{id}", post.Delete(db, vk))
-	register("POST /ui/v1/posts/{id}/comment", post.AddComment(db, vk))
+	register("POST /ui/v1/posts", limiter.Limit("create_post", createPostRule, post.Create(store)))
+	register("GET /ui/v1/posts", post.List(store))
+	register("POST /ui/v1/posts:batchCreate", limiter.Limit("batch_post", batchPostRule, post.BatchCreate(store)))
+	register("POST /ui/v1/posts:batchDelete", limiter.Limit("batch_post", batchPostRule, post.BatchDelete(store, hub)))
+	register("GET /ui/v1/posts/{id}", post.GetByID(store))
+	register("PATCH /ui/v1/posts/{id}", limiter.Limit("write_post", writePostRule, post.Update(store, hub)))
+	register("DELETE /ui/v1/posts/{id}", limiter.Limit("write_post", writePostRule, post.Delete(store, hub)))
+	register("GET /ui/v1/posts/{id}/revisions", post.Revisions(store))
+	register("GET /ui/v1/posts/{id}/revisions/diff", post.RevisionDiff(store))
+	register("POST /ui/v1/posts/{id}/restore", limiter.Limit("write_post", writePostRule, post.Restore(store)))
+	register("GET /ui/v1/trash", post.Trash(store, trashRetention))
+	register("POST /ui/v1/posts/{id}/comment", limiter.Limit("comment", commentRule, post.AddComment(store, hub)))
+	register("GET /ui/v1/posts/{id}/comment/{comment_id}", post.GetCommentStatus(store))
+	register("DELETE /ui/v1/posts/{id}/comment/{comment_id}", limiter.Limit("comment", commentRule, post.DeleteComment(store, hub)))
+	register("GET /ui/v1/posts/{id}/live", post.Live(store, hub))
+	register("GET /ui/v1/attachments/{id}", post.Download(store, false))
+	register("GET /ui/v1/attachments/{id}/thumbnail", post.Download(store, true))
+	register("GET /ui/v1/export", post.Export(store))
+	register("POST /ui/v1/import", limiter.Limit("import", importRule, post.Import(store)))
+	register("POST /ui/v1/webhooks", limiter.Limit("webhook", webhookRule, limitBody(maxBodySize, webhook.CreateHandler(webhooks))))
+	register("GET /ui/v1/webhooks", webhook.ListHandler(webhooks))
+	register("DELETE /ui/v1/webhooks/{id}", limiter.Limit("webhook", webhookRule, webhook.DeleteHandler(webhooks)))
+	register("GET /ui/v1/webhooks/{id}/deliveries", webhook.DeliveriesHandler(webhooks))
+	graphQL := graph.Handler(store, hub)
+	register("GET /graphql", limiter.Limit("graphql", graphQLRule, graphQL))
+	register("POST /graphql", limiter.Limit("graphql", graphQLRule, limitBody(maxBodySize, graphQL)))
 	slog.Info("Registered endpoints")
 }
+
+// limitBody lets next read at most limit bytes of the request body. The post handlers limit their own bodies.
+func limitBody(limit int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next(w, r)
+	}
+}
+
+// withFaults lets every route be slowed down or failed from the admin server.
+func withFaults(register RegisterFunc, faults *fault.Injector) RegisterFunc {
+	return func(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+		register(pattern, faults.Wrap(handler))
+	}
+}
+
+// withCompression compresses the responses of every route, including the faults injected into them.
+func withCompression(register RegisterFunc, compressor *compression.Compressor) RegisterFunc {
+	return func(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+		register(pattern, compressor.Wrap(handler))
+	}
+}
+
+// withWorkspace runs every route in the workspace of its request, which the rate limits and the stores read from the
+// context.
+func withWorkspace(register RegisterFunc, resolver *tenant.Resolver) RegisterFunc {
+	return func(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+		register(pattern, resolver.Wrap(handler))
+	}
+}
+
+// withReplicas lets the safe requests of every route read from a replica, and keeps the clients that write on the
+// primary for a while.
+func withReplicas(register RegisterFunc, replicas *replica.Pool) RegisterFunc {
+	return func(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+		register(pattern, replicas.Wrap(handler))
+	}
+}
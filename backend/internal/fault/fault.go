@@ -0,0 +1,146 @@
+package fault
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/internal/telemetry"
+)
+
+// Fault slows down or fails the requests whose path starts with PathPrefix.
+type Fault struct {
+	PathPrefix string `json:"path_prefix"`
+	// Latency is added before the handler runs.
+	Latency Duration `json:"latency"`
+	// ErrorRate is the probability, between 0 and 1, of answering ErrorStatus instead of running the handler.
+	ErrorRate   float64 `json:"error_rate"`
+	ErrorStatus int     `json:"error_status"`
+}
+
+// Duration is a time.Duration written as a string such as "250ms" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (f Fault) validate() error {
+	if f.Latency < 0 {
+		return errors.New("latency must not be negative")
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 {
+		return errors.New("error_rate must be between 0 and 1")
+	}
+	if f.ErrorRate > 0 && (f.ErrorStatus < 400 || f.ErrorStatus > 599) {
+		return errors.New("error_status must be a 4xx or 5xx status")
+	}
+	return nil
+}
+
+// Injector holds the faults of this replica, to rehearse how slow or failing endpoints show up in traces.
+type Injector struct {
+	mu     sync.RWMutex
+	faults []Fault
+}
+
+func NewInjector() *Injector {
+	return &Injector{}
+}
+
+func (i *Injector) Faults() []Fault {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return append([]Fault{}, i.faults...)
+}
+
+// Set replaces the faults. An empty list clears them.
+func (i *Injector) Set(faults []Fault) error {
+	for _, f := range faults {
+		if err := f.validate(); err != nil {
+			return err
+		}
+	}
+	i.mu.Lock()
+	i.faults = faults
+	i.mu.Unlock()
+	return nil
+}
+
+func (i *Injector) match(path string) (Fault, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for _, f := range i.faults {
+		if strings.HasPrefix(path, f.PathPrefix) {
+			return f, true
+		}
+	}
+	return Fault{}, false
+}
+
+// Wrap applies the first fault matching the request path before calling next.
+func (i *Injector) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := i.match(r.URL.Path)
+		if !ok {
+			next(w, r)
+			return
+		}
+		if f.Latency > 0 {
+			telemetry.SetTag(r.Context(), "fault.latency", time.Duration(f.Latency).String())
+			select {
+			case <-time.After(time.Duration(f.Latency)):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+			telemetry.SetTag(r.Context(), "fault.error_status", f.ErrorStatus)
+			http.Error(w, "injected fault", f.ErrorStatus)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func Handler(injector *Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var req struct {
+				Faults []Fault `json:"faults"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := injector.Set(req.Faults); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		response := struct {
+			Faults []Fault `json:"faults"`
+		}{
+			Faults: injector.Faults(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
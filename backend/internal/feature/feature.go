@@ -0,0 +1,162 @@
+package feature
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"backend/internal/telemetry"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// Flag names a behaviour that can be switched at runtime to compare alternate code paths.
+type Flag string
+
+const (
+	// ListPostPKCache resolves the cursor post of a listing from the post_pk cache instead of a subquery.
+	ListPostPKCache Flag = "list_post_pk_cache"
+	// CommentCountCache reads comment counts from Valkey instead of counting them in the database.
+	CommentCountCache Flag = "comment_count_cache"
+	// SubqueryFallback counts the comments of a post missing from the cache with a subquery on its public ID
+	// instead of resolving its primary key first.
+	SubqueryFallback Flag = "subquery_fallback"
+	// AsyncComments accepts new comments with 202 and persists them from a job instead of within the request.
+	AsyncComments Flag = "async_comments"
+)
+
+var defaults = map[Flag]bool{
+	ListPostPKCache:   true,
+	CommentCountCache: true,
+	SubqueryFallback:  true,
+	AsyncComments:     false,
+}
+
+var ErrUnknownFlag = errors.New("unknown feature flag")
+
+// valkeyKey is the hash holding the flags that were switched away from their default.
+const valkeyKey = "feature_flags"
+
+// Flags evaluates feature flags from memory.
+// With a Valkey client, changes are stored in Valkey and Run picks up those made by other replicas.
+type Flags struct {
+	vk        valkey.Client
+	mu        sync.RWMutex
+	overrides map[Flag]bool
+}
+
+// NewFlags returns flags with their defaults. vk may be nil to keep flags local to this process.
+func NewFlags(vk valkey.Client) *Flags {
+	return &Flags{vk: vk, overrides: make(map[Flag]bool)}
+}
+
+// Enabled reports whether the flag is on and records the evaluation on the current span.
+func (f *Flags) Enabled(ctx context.Context, flag Flag) bool {
+	f.mu.RLock()
+	enabled, ok := f.overrides[flag]
+	f.mu.RUnlock()
+	if !ok {
+		enabled = defaults[flag]
+	}
+	telemetry.SetTag(ctx, "feature_flag."+string(flag), enabled)
+	return enabled
+}
+
+// State is the value of a flag.
+type State struct {
+	Name     Flag `json:"name"`
+	Enabled  bool `json:"enabled"`
+	Default  bool `json:"default"`
+	Override bool `json:"override"`
+}
+
+// All returns the state of every flag, sorted by name.
+func (f *Flags) All() []State {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	states := make([]State, 0, len(defaults))
+	for _, name := range slices.Sorted(maps.Keys(defaults)) {
+		enabled, override := f.overrides[name]
+		if !override {
+			enabled = defaults[name]
+		}
+		states = append(states, State{Name: name, Enabled: enabled, Default: defaults[name], Override: override})
+	}
+	return states
+}
+
+// Set switches the flag for every replica.
+func (f *Flags) Set(ctx context.Context, flag Flag, enabled bool) error {
+	if _, ok := defaults[flag]; !ok {
+		return ErrUnknownFlag
+	}
+	if f.vk != nil {
+		if err := f.vk.Do(ctx, f.vk.B().Hset().Key(valkeyKey).FieldValue().FieldValue(string(flag), strconv.FormatBool(enabled)).Build()).Error(); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	f.overrides[flag] = enabled
+	f.mu.Unlock()
+	return nil
+}
+
+// Reset puts the flag back to its default for every replica.
+func (f *Flags) Reset(ctx context.Context, flag Flag) error {
+	if _, ok := defaults[flag]; !ok {
+		return ErrUnknownFlag
+	}
+	if f.vk != nil {
+		if err := f.vk.Do(ctx, f.vk.B().Hdel().Key(valkeyKey).Field(string(flag)).Build()).Error(); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	delete(f.overrides, flag)
+	f.mu.Unlock()
+	return nil
+}
+
+// Run reloads the flags from Valkey every interval until ctx is done.
+func (f *Flags) Run(ctx context.Context, interval time.Duration) {
+	if f.vk == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := f.load(ctx); err != nil {
+			slog.ErrorContext(ctx, "failed to load feature flags from valkey", slog.Any("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *Flags) load(ctx context.Context) error {
+	stored, err := f.vk.Do(ctx, f.vk.B().Hgetall().Key(valkeyKey).Build()).AsStrMap()
+	if err != nil {
+		return err
+	}
+	overrides := make(map[Flag]bool, len(stored))
+	for name, v := range stored {
+		if _, ok := defaults[Flag(name)]; !ok {
+			continue
+		}
+		if enabled, err := strconv.ParseBool(v); err == nil {
+			overrides[Flag(name)] = enabled
+		}
+	}
+	f.mu.Lock()
+	f.overrides = overrides
+	f.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,57 @@
+package feature
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func ListHandler(flags *Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := struct {
+			Flags []State `json:"flags"`
+		}{
+			Flags: flags.All(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func SetHandler(flags *Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Enabled == nil {
+			http.Error(w, "missing enabled", http.StatusBadRequest)
+			return
+		}
+		if err := flags.Set(r.Context(), Flag(r.PathValue("name")), *req.Enabled); err != nil {
+			if err == ErrUnknownFlag {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ResetHandler(flags *Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := flags.Reset(r.Context(), Flag(r.PathValue("name"))); err != nil {
+			if err == ErrUnknownFlag {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,104 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"backend/internal/live"
+	"backend/internal/post"
+	"backend/internal/replica"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+type request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Handler serves GraphQL queries over posts and comments. GET requests may only carry queries, so that a link cannot
+// run a mutation.
+// Comment fetches are batched per request unless the dataloader=false query parameter is set,
+// which makes the N+1 query pattern visible in DBM.
+func Handler(store *post.Store, hub *live.Hub) http.HandlerFunc {
+	schema, err := newSchema(store, hub)
+	if err != nil {
+		slog.Error("Failed to build GraphQL schema", slog.Any("error", err))
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		switch r.Method {
+		case http.MethodGet:
+			req.Query = r.URL.Query().Get("query")
+			req.OperationName = r.URL.Query().Get("operationName")
+			if v := r.URL.Query().Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		default:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Query == "" {
+			http.Error(w, "missing query", http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+		// Documents that do not parse or name no operation to run are left to graphql.Do, which reports the error.
+		if op, err := operationType(req); err == nil {
+			if r.Method == http.MethodGet && op != ast.OperationTypeQuery {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, op+" operations must be sent with POST", http.StatusMethodNotAllowed)
+				return
+			}
+			// Queries read from the replicas whatever their method.
+			if op == ast.OperationTypeQuery {
+				ctx = replica.ReadOnly(ctx)
+			}
+		}
+		loader := newCommentLoader(store, r.URL.Query().Get("dataloader") != "false")
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			OperationName:  req.OperationName,
+			VariableValues: req.Variables,
+			Context:        context.WithValue(ctx, loaderKey{}, loader),
+		})
+		if result.HasErrors() {
+			slog.WarnContext(r.Context(), "graphql request returned errors", slog.Any("errors", result.Errors))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// operationType returns the type of the operation of req that runs: query, mutation or subscription.
+func operationType(req request) (string, error) {
+	doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+	if err != nil {
+		return "", err
+	}
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if req.OperationName == "" || (op.Name != nil && op.Name.Value == req.OperationName) {
+			return op.Operation, nil
+		}
+	}
+	return "", errors.New("no operation to run")
+}
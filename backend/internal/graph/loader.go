@@ -0,0 +1,64 @@
+package graph
+
+import (
+	"context"
+	"sync"
+
+	"backend/internal/post"
+)
+
+// commentLoader batches the comment fetches of a GraphQL request.
+// Resolvers register the post they need and return a thunk; graphql-go resolves all the
+// fields of a level before calling the thunks, so the first thunk loads every registered post at once.
+// With batching disabled, each post loads its own comments, reproducing the N+1 query pattern.
+type commentLoader struct {
+	store *post.Store
+	batch bool
+
+	mu      sync.Mutex
+	pending []string
+	loaded  map[string][]post.Comment
+	err     error
+}
+
+func newCommentLoader(store *post.Store, batch bool) *commentLoader {
+	return &commentLoader{
+		store:  store,
+		batch:  batch,
+		loaded: make(map[string][]post.Comment),
+	}
+}
+
+func (l *commentLoader) load(ctx context.Context, postID string) func() (interface{}, error) {
+	if !l.batch {
+		comments, err := l.store.Comments(ctx, postID)
+		return func() (interface{}, error) {
+			return comments, err
+		}
+	}
+	l.mu.Lock()
+	l.pending = append(l.pending, postID)
+	l.mu.Unlock()
+	return func() (interface{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if len(l.pending) > 0 {
+			byPost, err := l.store.CommentsByPosts(ctx, l.pending)
+			if err != nil {
+				l.err = err
+			}
+			for _, id := range l.pending {
+				l.loaded[id] = byPost[id]
+			}
+			l.pending = nil
+		}
+		if l.err != nil {
+			return nil, l.err
+		}
+		comments := l.loaded[postID]
+		if comments == nil {
+			comments = []post.Comment{}
+		}
+		return comments, nil
+	}
+}
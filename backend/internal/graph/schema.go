@@ -0,0 +1,253 @@
+package graph
+
+import (
+	"context"
+
+	"backend/internal/live"
+	"backend/internal/post"
+
+	"github.com/graphql-go/graphql"
+)
+
+type loaderKey struct{}
+
+func loaderFromContext(ctx context.Context) *commentLoader {
+	return ctx.Value(loaderKey{}).(*commentLoader)
+}
+
+func newSchema(store *post.Store, hub *live.Hub) (graphql.Schema, error) {
+	commentType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Comment",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(post.Comment).PublicID, nil
+				},
+			},
+			"body": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(post.Comment).Body, nil
+				},
+			},
+		},
+	})
+
+	postType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Post",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(post.Post).PublicID, nil
+				},
+			},
+			"body": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(post.Post).Body, nil
+				},
+			},
+			"renderedHtml": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(post.Post).RenderedHTML, nil
+				},
+			},
+			"commentCount": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(post.Post).CommentCount, nil
+				},
+			},
+			"editedAt": &graphql.Field{
+				Type: graphql.DateTime,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if editedAt := p.Source.(post.Post).EditedAt; editedAt != nil {
+						return *editedAt, nil
+					}
+					return nil, nil
+				},
+			},
+			"comments": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(commentType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return loaderFromContext(p.Context).load(p.Context, p.Source.(post.Post).PublicID), nil
+				},
+			},
+		},
+	})
+
+	postPageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PostPage",
+		Fields: graphql.Fields{
+			"posts":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(postType)))},
+			"total":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"hasMore":    &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"nextCursor": &graphql.Field{Type: graphql.String},
+			"prevCursor": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	sortType := graphql.NewEnum(graphql.EnumConfig{
+		Name: "PostSort",
+		Values: graphql.EnumValueConfigMap{
+			"NEWEST":         &graphql.EnumValueConfig{Value: string(post.SortNewest)},
+			"OLDEST":         &graphql.EnumValueConfig{Value: string(post.SortOldest)},
+			"MOST_COMMENTED": &graphql.EnumValueConfig{Value: string(post.SortMostCommented)},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"posts": &graphql.Field{
+				Type: graphql.NewNonNull(postPageType),
+				Args: graphql.FieldConfigArgument{
+					"limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 10},
+					"sort":   &graphql.ArgumentConfig{Type: sortType, DefaultValue: string(post.SortNewest)},
+					"cursor": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					limit, _ := p.Args["limit"].(int)
+					if limit < 1 || limit > 100 {
+						limit = 10
+					}
+					sort, _ := p.Args["sort"].(string)
+					cursor, _ := p.Args["cursor"].(string)
+					page, err := store.List(p.Context, post.ListOptions{
+						Limit:  limit,
+						Sort:   post.Sort(sort),
+						Cursor: cursor,
+					})
+					if err != nil {
+						return nil, err
+					}
+					total, err := store.TotalCount(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					if page.Sort != post.SortMostCommented {
+						store.FillCommentCounts(p.Context, page.Posts)
+					}
+					store.FillRenderedHTML(p.Context, page.Posts)
+					result := map[string]interface{}{
+						"posts":   page.Posts,
+						"total":   total,
+						"hasMore": page.HasMore,
+					}
+					if page.NextCursor != "" {
+						result["nextCursor"] = page.NextCursor
+					}
+					if page.PrevCursor != "" {
+						result["prevCursor"] = page.PrevCursor
+					}
+					return result, nil
+				},
+			},
+			"post": &graphql.Field{
+				Type: postType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					found, err := store.Get(p.Context, p.Args["id"].(string))
+					if err != nil {
+						if err == post.ErrPostNotFound {
+							return nil, nil
+						}
+						return nil, err
+					}
+					posts := []post.Post{found}
+					store.FillCommentCounts(p.Context, posts)
+					store.FillRenderedHTML(p.Context, posts)
+					return posts[0], nil
+				},
+			},
+			"postCount": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return store.TotalCount(p.Context)
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createPost": &graphql.Field{
+				Type: graphql.NewNonNull(postType),
+				Args: graphql.FieldConfigArgument{
+					"body": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					created, err := store.Create(p.Context, p.Args["body"].(string))
+					if err != nil {
+						return nil, err
+					}
+					posts := []post.Post{created}
+					store.FillRenderedHTML(p.Context, posts)
+					return posts[0], nil
+				},
+			},
+			"updatePost": &graphql.Field{
+				Type: graphql.NewNonNull(postType),
+				Args: graphql.FieldConfigArgument{
+					"id":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"body": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					updated, err := store.Update(p.Context, id, p.Args["body"].(string), "")
+					if err != nil {
+						return nil, err
+					}
+					// Live clients show the new body without fetching the post again.
+					posts := []post.Post{updated}
+					store.FillRenderedHTML(p.Context, posts)
+					hub.Publish(p.Context, id, live.EventPostUpdated, posts[0])
+					return posts[0], nil
+				},
+			},
+			"deletePost": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					if err := store.Delete(p.Context, id, ""); err != nil {
+						return false, err
+					}
+					hub.Publish(p.Context, id, live.EventPostDeleted, struct {
+						ID string `json:"id"`
+					}{ID: id})
+					return true, nil
+				},
+			},
+			"addComment": &graphql.Field{
+				Type: graphql.NewNonNull(commentType),
+				Args: graphql.FieldConfigArgument{
+					"postId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"body":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					postID := p.Args["postId"].(string)
+					comment, err := store.AddComment(p.Context, postID, p.Args["body"].(string))
+					if err != nil {
+						return nil, err
+					}
+					hub.Publish(p.Context, postID, live.EventCommentAdded, comment)
+					return comment, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    query,
+		Mutation: mutation,
+	})
+}
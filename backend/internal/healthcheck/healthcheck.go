@@ -2,7 +2,6 @@ package healthcheck
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"net/http"
 
@@ -35,26 +34,19 @@ func LivenessHandler() http.HandlerFunc {
 
 func checkDatabaseSchema(ctx context.Context, db *sqlx.DB) error {
 	// Check post table
-	postRows, err := db.QueryContext(ctx, "DESC ddfeed.post")
+	postColumns, err := columns(ctx, db, "post")
 	if err != nil {
 		return fmt.Errorf("failed to check post table: %w", err)
 	}
-	defer postRows.Close()
-
-	postColumns := make(map[string]struct{})
-	for postRows.Next() {
-		var field, type_, null, key, default_, extra sql.NullString
-		if err := postRows.Scan(&field, &type_, &null, &key, &default_, &extra); err != nil {
-			return fmt.Errorf("failed to scan post table columns: %w", err)
-		}
-		postColumns[field.String] = struct{}{}
-	}
 
 	requiredPostColumns := map[string]struct{}{
 		"id":         {},
 		"body":       {},
 		"created_at": {},
 		"updated_at": {},
+		"edited_at":  {},
+		"deleted_at": {},
+		"moderation": {},
 	}
 
 	for col := range requiredPostColumns {
@@ -64,20 +56,10 @@ func checkDatabaseSchema(ctx context.Context, db *sqlx.DB) error {
 	}
 
 	// Check comment table
-	commentRows, err := db.QueryContext(ctx, "DESC ddfeed.comment")
+	commentColumns, err := columns(ctx, db, "comment")
 	if err != nil {
 		return fmt.Errorf("failed to check comment table: %w", err)
 	}
-	defer commentRows.Close()
-
-	commentColumns := make(map[string]struct{})
-	for commentRows.Next() {
-		var field, type_, null, key, default_, extra sql.NullString
-		if err := commentRows.Scan(&field, &type_, &null, &key, &default_, &extra); err != nil {
-			return fmt.Errorf("failed to scan comment table columns: %w", err)
-		}
-		commentColumns[field.String] = struct{}{}
-	}
 
 	requiredCommentColumns := map[string]struct{}{
 		"id":         {},
@@ -85,6 +67,7 @@ func checkDatabaseSchema(ctx context.Context, db *sqlx.DB) error {
 		"post_id":    {},
 		"created_at": {},
 		"updated_at": {},
+		"moderation": {},
 	}
 
 	for col := range requiredCommentColumns {
@@ -95,3 +78,21 @@ func checkDatabaseSchema(ctx context.Context, db *sqlx.DB) error {
 
 	return nil
 }
+
+// columns returns the column names of the table. Selecting no rows works the same in MySQL, PostgreSQL and SQLite.
+func columns(ctx context.Context, db *sqlx.DB, table string) (map[string]struct{}, error) {
+	rows, err := db.QueryContext(ctx, "SELECT * FROM "+table+" WHERE 1 = 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		columns[name] = struct{}{}
+	}
+	return columns, nil
+}
@@ -0,0 +1,59 @@
+package job
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+func StatsHandler(queue *Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := queue.Stats(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
+
+func DeadHandler(queue *Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit < 1 || limit > maxDead {
+			limit = 10
+		}
+		jobs, err := queue.DeadJobs(r.Context(), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response := struct {
+			Jobs  []DeadJob `json:"jobs"`
+			Limit int       `json:"limit"`
+		}{
+			Jobs:  jobs,
+			Limit: limit,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func RetryDeadHandler(queue *Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		retried, err := queue.RetryDead(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response := struct {
+			Retried int `json:"retried"`
+		}{
+			Retried: retried,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
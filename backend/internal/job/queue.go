@@ -0,0 +1,423 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"backend/internal/telemetry"
+	"backend/internal/tenant"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/valkey-io/valkey-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The keys share a hash tag so that the promote script, which uses two of them, also works on a Valkey cluster.
+const (
+	streamKey    = "{jobs}:stream"
+	scheduledKey = "{jobs}:scheduled"
+	deadKey      = "{jobs}:dead"
+	// retryingKey holds the dead jobs RetryDead is enqueuing again.
+	retryingKey = "{jobs}:retrying"
+	group       = "workers"
+
+	// DefaultMaxAttempts is how many times a job runs before it is moved to the dead-letter list.
+	DefaultMaxAttempts = 5
+	// maxDead bounds the dead-letter list, dropping the oldest jobs.
+	maxDead = 1000
+	// maxStreamLength bounds the stream. Acknowledged jobs are deleted, so it only grows when workers fall behind.
+	maxStreamLength = 100000
+	// reclaimIdle is how long a job may stay unacknowledged before another worker takes it over,
+	// e.g. after the replica running it crashed.
+	reclaimIdle = 5 * time.Minute
+	readBlock   = 2 * time.Second
+	maxBackoff  = 5 * time.Minute
+)
+
+var ErrNoHandler = errors.New("no handler for job kind")
+
+// promote moves the jobs of KEYS[1] due by the Valkey clock to the stream KEYS[2], at most ARGV[1] at a time.
+// Doing it in a script keeps several replicas from promoting the same job twice.
+var promote = valkey.NewLuaScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, tonumber(ARGV[1]))
+for _, job in ipairs(due) do
+	redis.call('ZREM', KEYS[1], job)
+	redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[2], '*', 'job', job)
+end
+return #due
+`)
+
+// Job is a unit of work. Its trace context travels with it so that the job span joins the trace that enqueued it,
+// and so does the workspace it was enqueued in, which its handler runs in.
+type Job struct {
+	ID         string            `json:"id"`
+	Kind       string            `json:"kind"`
+	Payload    json.RawMessage   `json:"payload"`
+	Attempt    int               `json:"attempt"`
+	EnqueuedAt time.Time         `json:"enqueued_at"`
+	Trace      map[string]string `json:"trace,omitempty"`
+	Workspace  string            `json:"workspace,omitempty"`
+}
+
+// Decode unmarshals the payload into v.
+func (j Job) Decode(v any) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// DeadJob is a job that failed on its last attempt.
+type DeadJob struct {
+	Job
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+type Handler func(ctx context.Context, job Job) error
+
+// Queue runs jobs on a pool of workers, taking them from a Valkey stream shared by every replica.
+// Jobs are delivered at least once, so handlers must be idempotent.
+type Queue struct {
+	vk          valkey.Client
+	consumer    string
+	workers     int
+	maxAttempts int
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+func NewQueue(vk valkey.Client, workers int) *Queue {
+	host, _ := os.Hostname()
+	return &Queue{
+		vk:          vk,
+		consumer:    host + "-" + ulid.Make().String(),
+		workers:     workers,
+		maxAttempts: DefaultMaxAttempts,
+		handlers:    make(map[string]Handler),
+	}
+}
+
+// Handle registers the handler of a job kind. It must be called before Run.
+func (q *Queue) Handle(kind string, handler Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = handler
+}
+
+// Enqueue adds a job to run as soon as a worker is free.
+func (q *Queue) Enqueue(ctx context.Context, kind string, payload any) error {
+	return q.Schedule(ctx, kind, payload, time.Time{})
+}
+
+// Schedule adds a job to run at the given time.
+func (q *Queue) Schedule(ctx context.Context, kind string, payload any, at time.Time) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	job := Job{
+		ID:         ulid.Make().String(),
+		Kind:       kind,
+		Payload:    raw,
+		Attempt:    1,
+		EnqueuedAt: time.Now().UTC(),
+	}
+	job.Workspace, _ = tenant.FromContext(ctx)
+	ctx, span := telemetry.Tracer().Start(ctx, "job.enqueue",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("job.kind", kind),
+			attribute.String("job.id", job.ID),
+		),
+	)
+	defer span.End()
+	job.Trace = telemetry.Inject(ctx)
+	if err := q.add(ctx, job, at); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (q *Queue) add(ctx context.Context, job Job, at time.Time) error {
+	msg, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if at.After(time.Now()) {
+		return q.vk.Do(ctx, q.vk.B().Zadd().Key(scheduledKey).ScoreMember().ScoreMember(float64(at.UnixMilli()), string(msg)).Build()).Error()
+	}
+	return q.vk.Do(ctx, q.vk.B().Xadd().Key(streamKey).Maxlen().Almost().Threshold(strconv.Itoa(maxStreamLength)).Id("*").FieldValue().FieldValue("job", string(msg)).Build()).Error()
+}
+
+// Run starts the workers and the scheduler, and blocks until ctx is done.
+func (q *Queue) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := q.vk.Do(ctx, q.vk.B().XgroupCreate().Key(streamKey).Group(group).Id("0").Mkstream().Build()).Error()
+		if err == nil || valkey.IsValkeyBusyGroup(err) {
+			break
+		}
+		slog.ErrorContext(ctx, "failed to create job consumer group, retrying", slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.runScheduler(ctx)
+	}()
+	for i := range q.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.runWorker(ctx, fmt.Sprintf("%s-%d", q.consumer, i))
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := promote.Exec(ctx, q.vk, []string{scheduledKey, streamKey}, []string{"100", strconv.Itoa(maxStreamLength)}).Error(); err != nil {
+			slog.ErrorContext(ctx, "failed to promote scheduled jobs", slog.Any("error", err))
+		}
+	}
+}
+
+func (q *Queue) runWorker(ctx context.Context, consumer string) {
+	for ctx.Err() == nil {
+		streams, err := q.vk.Do(ctx, q.vk.B().Xreadgroup().Group(group, consumer).Count(1).Block(readBlock.Milliseconds()).Streams().Key(streamKey).Id(">").Build()).AsXRead()
+		if valkey.IsValkeyNil(err) {
+			// Idle, look for jobs abandoned by another worker.
+			q.reclaim(ctx, consumer)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "failed to read jobs", slog.Any("error", err))
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		for _, entry := range streams[streamKey] {
+			q.process(ctx, entry)
+		}
+	}
+}
+
+func (q *Queue) reclaim(ctx context.Context, consumer string) {
+	result, err := q.vk.Do(ctx, q.vk.B().Xautoclaim().Key(streamKey).Group(group).Consumer(consumer).MinIdleTime(strconv.FormatInt(reclaimIdle.Milliseconds(), 10)).Start("0").Count(1).Build()).ToArray()
+	if err != nil || len(result) < 2 {
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "failed to reclaim jobs", slog.Any("error", err))
+		}
+		return
+	}
+	entries, err := result[1].AsXRange()
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		q.process(ctx, entry)
+	}
+}
+
+func (q *Queue) process(ctx context.Context, entry valkey.XRangeEntry) {
+	// Acknowledging last means a crash before it runs the job again rather than losing it.
+	defer func() {
+		ack := q.vk.DoMulti(context.WithoutCancel(ctx),
+			q.vk.B().Xack().Key(streamKey).Group(group).Id(entry.ID).Build(),
+			q.vk.B().Xdel().Key(streamKey).Id(entry.ID).Build(),
+		)
+		for _, res := range ack {
+			if err := res.Error(); err != nil {
+				slog.ErrorContext(ctx, "failed to acknowledge job", slog.String("entry_id", entry.ID), slog.Any("error", err))
+			}
+		}
+	}()
+	var job Job
+	if err := json.Unmarshal([]byte(entry.FieldValues["job"]), &job); err != nil {
+		slog.ErrorContext(ctx, "dropping undecodable job", slog.String("entry_id", entry.ID), slog.Any("error", err))
+		return
+	}
+
+	ctx = telemetry.Extract(ctx, job.Trace)
+	if job.Workspace != "" {
+		ctx = tenant.With(ctx, job.Workspace)
+	}
+	ctx, span := telemetry.Tracer().Start(ctx, "job.process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("resource.name", job.Kind),
+			attribute.String("job.kind", job.Kind),
+			attribute.String("job.id", job.ID),
+			attribute.Int("job.attempt", job.Attempt),
+			attribute.String(tenant.Tag, tenant.ID(ctx)),
+		),
+	)
+	defer span.End()
+	if err := q.run(ctx, job); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		q.fail(ctx, job, err)
+	}
+}
+
+func (q *Queue) run(ctx context.Context, job Job) (err error) {
+	q.mu.RLock()
+	handler, ok := q.handlers[job.Kind]
+	q.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w %q", ErrNoHandler, job.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// fail retries the job with an exponential backoff, or moves it to the dead-letter list after its last attempt.
+func (q *Queue) fail(ctx context.Context, job Job, jobErr error) {
+	ctx = context.WithoutCancel(ctx)
+	if job.Attempt >= q.maxAttempts {
+		slog.ErrorContext(ctx, "job failed on its last attempt", slog.String("job_id", job.ID), slog.String("job_kind", job.Kind), slog.Any("error", jobErr))
+		msg, err := json.Marshal(DeadJob{Job: job, Error: jobErr.Error(), FailedAt: time.Now().UTC()})
+		if err != nil {
+			return
+		}
+		for _, res := range q.vk.DoMulti(ctx,
+			q.vk.B().Lpush().Key(deadKey).Element(string(msg)).Build(),
+			q.vk.B().Ltrim().Key(deadKey).Start(0).Stop(maxDead-1).Build(),
+		) {
+			if err := res.Error(); err != nil {
+				slog.ErrorContext(ctx, "failed to move job to the dead-letter list", slog.String("job_id", job.ID), slog.Any("error", err))
+			}
+		}
+		return
+	}
+	backoff := min(time.Second<<(job.Attempt-1), maxBackoff)
+	// Jitter spreads the retries of jobs that failed together.
+	backoff += rand.N(backoff / 5)
+	slog.WarnContext(ctx, "job failed, retrying", slog.String("job_id", job.ID), slog.String("job_kind", job.Kind), slog.Int("attempt", job.Attempt), slog.Duration("backoff", backoff), slog.Any("error", jobErr))
+	job.Attempt++
+	if err := q.add(ctx, job, time.Now().Add(backoff)); err != nil {
+		slog.ErrorContext(ctx, "failed to schedule job retry", slog.String("job_id", job.ID), slog.Any("error", err))
+	}
+}
+
+// Stats describe the backlog of the queue.
+type Stats struct {
+	Ready     int64 `json:"ready"`
+	Pending   int64 `json:"pending"`
+	Scheduled int64 `json:"scheduled"`
+	Dead      int64 `json:"dead"`
+}
+
+func (q *Queue) Stats(ctx context.Context) (Stats, error) {
+	results := q.vk.DoMulti(ctx,
+		q.vk.B().Xlen().Key(streamKey).Build(),
+		q.vk.B().Xpending().Key(streamKey).Group(group).Build(),
+		q.vk.B().Zcard().Key(scheduledKey).Build(),
+		q.vk.B().Llen().Key(deadKey).Build(),
+	)
+	var stats Stats
+	var err error
+	if stats.Ready, err = results[0].AsInt64(); err != nil {
+		return Stats{}, err
+	}
+	// XPENDING without a range replies with the count first. The stream only holds unacknowledged jobs.
+	if pending, err := results[1].ToArray(); err == nil && len(pending) > 0 {
+		stats.Pending, _ = pending[0].AsInt64()
+		stats.Ready -= stats.Pending
+	}
+	if stats.Scheduled, err = results[2].AsInt64(); err != nil {
+		return Stats{}, err
+	}
+	if stats.Dead, err = results[3].AsInt64(); err != nil {
+		return Stats{}, err
+	}
+	return stats, nil
+}
+
+// DeadJobs returns up to limit dead jobs, most recent first.
+func (q *Queue) DeadJobs(ctx context.Context, limit int) ([]DeadJob, error) {
+	msgs, err := q.vk.Do(ctx, q.vk.B().Lrange().Key(deadKey).Start(0).Stop(int64(limit-1)).Build()).AsStrSlice()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]DeadJob, 0, len(msgs))
+	for _, msg := range msgs {
+		var job DeadJob
+		if err := json.Unmarshal([]byte(msg), &job); err == nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// RetryDead enqueues the dead jobs again with fresh attempts and returns how many were enqueued.
+// Each job waits in a list of jobs being retried until it is enqueued, and goes back to the dead-letter list if that
+// fails. The jobs left there by a call that did not finish are dead again first, so they run at least once.
+func (q *Queue) RetryDead(ctx context.Context) (int, error) {
+	for {
+		err := q.vk.Do(ctx, q.vk.B().Lmove().Source(retryingKey).Destination(deadKey).Left().Right().Build()).Error()
+		if valkey.IsValkeyNil(err) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	var retried int
+	for {
+		msg, err := q.vk.Do(ctx, q.vk.B().Lmove().Source(deadKey).Destination(retryingKey).Right().Left().Build()).ToString()
+		if valkey.IsValkeyNil(err) {
+			return retried, nil
+		}
+		if err != nil {
+			return retried, err
+		}
+		var dead DeadJob
+		if err := json.Unmarshal([]byte(msg), &dead); err == nil {
+			dead.Job.Attempt = 1
+			if err := q.add(ctx, dead.Job, time.Time{}); err != nil {
+				for _, res := range q.vk.DoMulti(ctx,
+					q.vk.B().Rpush().Key(deadKey).Element(msg).Build(),
+					q.vk.B().Lrem().Key(retryingKey).Count(1).Element(msg).Build(),
+				) {
+					if res.Error() != nil {
+						slog.ErrorContext(ctx, "failed to put back dead job", slog.String("job_id", dead.Job.ID), slog.Any("error", res.Error()))
+					}
+				}
+				return retried, err
+			}
+			retried++
+		}
+		if err := q.vk.Do(ctx, q.vk.B().Lrem().Key(retryingKey).Count(1).Element(msg).Build()).Error(); err != nil {
+			return retried, err
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"backend/internal/telemetry"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/oklog/ulid/v2"
+	"github.com/valkey-io/valkey-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	EventCommentAdded    = "comment.added"
+	EventCommentDeleted  = "comment.deleted"
+	EventCommentRejected = "comment.rejected"
+	EventPostUpdated     = "post.updated"
+	EventPostDeleted     = "post.deleted"
+	EventTyping          = "typing"
+)
+
+const (
+	DefaultMaxConnections        = 1000
+	DefaultMaxConnectionsPerPost = 100
+
+	channelPrefix     = "live:post:"
+	heartbeatInterval = 30 * time.Second
+	writeTimeout      = 10 * time.Second
+	sendBufferSize    = 16
+	maxMessageSize    = 4096
+)
+
+var ErrTooManyConnections = errors.New("too many live connections")
+
+// Event is a message pushed to the clients watching a post.
+type Event struct {
+	Type   string            `json:"type"`
+	PostID string            `json:"post_id"`
+	Data   json.RawMessage   `json:"data,omitempty"`
+	From   string            `json:"from,omitempty"`
+	Trace  map[string]string `json:"trace,omitempty"`
+}
+
+// clientMessage is a message sent by a client over its WebSocket.
+// Trace optionally carries a W3C trace context (e.g. injected by RUM) to continue the client's trace.
+type clientMessage struct {
+	Type  string            `json:"type"`
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+type typing struct {
+	ClientID string `json:"client_id"`
+}
+
+type conn struct {
+	id     string
+	postID string
+	events chan Event
+	cancel context.CancelFunc
+}
+
+// Hub fans out post events to WebSocket clients.
+// Events go through Valkey pub/sub so that every backend replica delivers them to its own clients.
+type Hub struct {
+	vk                    valkey.Client
+	maxConnections        int
+	maxConnectionsPerPost int
+	// originPatterns are the origins of the pages allowed to connect, besides the host of the request.
+	originPatterns []string
+
+	mu    sync.Mutex
+	total int
+	conns map[string]map[*conn]struct{}
+}
+
+// NewHub returns a Hub accepting the WebSockets opened by the pages of origins, given as scheme://host.
+func NewHub(vk valkey.Client, origins []string) *Hub {
+	return &Hub{
+		vk:                    vk,
+		maxConnections:        DefaultMaxConnections,
+		maxConnectionsPerPost: DefaultMaxConnectionsPerPost,
+		originPatterns:        origins,
+		conns:                 make(map[string]map[*conn]struct{}),
+	}
+}
+
+// Run subscribes to the events of all posts and dispatches them to the local clients until ctx is done.
+func (h *Hub) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := h.vk.Receive(ctx, h.vk.B().Psubscribe().Pattern(channelPrefix+"*").Build(), func(msg valkey.PubSubMessage) {
+			var ev Event
+			if err := json.Unmarshal([]byte(msg.Message), &ev); err != nil {
+				slog.ErrorContext(ctx, "failed to decode live event", slog.String("channel", msg.Channel), slog.Any("error", err))
+				return
+			}
+			h.dispatch(ctx, ev)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		slog.ErrorContext(ctx, "live event subscription stopped, retrying", slog.Any("error", err))
+		time.Sleep(time.Second)
+	}
+}
+
+// Publish sends an event to every client watching the post, on any replica.
+func (h *Hub) Publish(ctx context.Context, postID, eventType string, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to encode live event data", slog.Any("error", err))
+		return
+	}
+	h.publish(ctx, Event{Type: eventType, PostID: postID, Data: raw})
+}
+
+func (h *Hub) publish(ctx context.Context, ev Event) {
+	ctx, span := telemetry.Tracer().Start(ctx, "live.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("live.event", ev.Type),
+			attribute.String("post.id", ev.PostID),
+		),
+	)
+	defer span.End()
+	ev.Trace = telemetry.Inject(ctx)
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "failed to encode live event", slog.Any("error", err))
+		return
+	}
+	if err := h.vk.Do(ctx, h.vk.B().Publish().Channel(channelPrefix+ev.PostID).Message(string(msg)).Build()).Error(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "failed to publish live event", slog.Any("error", err))
+	}
+}
+
+func (h *Hub) dispatch(ctx context.Context, ev Event) {
+	ctx, span := telemetry.Tracer().Start(telemetry.Extract(ctx, ev.Trace), "live.deliver",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("live.event", ev.Type),
+			attribute.String("post.id", ev.PostID),
+		),
+	)
+	defer span.End()
+	ev.Trace = nil
+
+	h.mu.Lock()
+	targets := make([]*conn, 0, len(h.conns[ev.PostID]))
+	for c := range h.conns[ev.PostID] {
+		if c.id != ev.From {
+			targets = append(targets, c)
+		}
+	}
+	h.mu.Unlock()
+
+	span.SetAttributes(attribute.Int("live.subscribers", len(targets)))
+	for _, c := range targets {
+		select {
+		case c.events <- ev:
+		default:
+			// The client does not keep up, drop it rather than blocking the other ones.
+			slog.WarnContext(ctx, "dropping slow live client", slog.String("post_id", ev.PostID), slog.String("client_id", c.id))
+			c.cancel()
+		}
+	}
+}
+
+func (h *Hub) register(c *conn) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.total >= h.maxConnections || len(h.conns[c.postID]) >= h.maxConnectionsPerPost {
+		return ErrTooManyConnections
+	}
+	if h.conns[c.postID] == nil {
+		h.conns[c.postID] = make(map[*conn]struct{})
+	}
+	h.conns[c.postID][c] = struct{}{}
+	h.total++
+	return nil
+}
+
+func (h *Hub) unregister(c *conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns[c.postID], c)
+	if len(h.conns[c.postID]) == 0 {
+		delete(h.conns, c.postID)
+	}
+	h.total--
+}
+
+// Serve upgrades the request to a WebSocket and streams the events of the post until the client goes away.
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, postID string) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	c := &conn{
+		id:     ulid.Make().String(),
+		postID: postID,
+		events: make(chan Event, sendBufferSize),
+		cancel: cancel,
+	}
+	if err := h.register(c); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unregister(c)
+
+	// Browsers send cookies with WebSockets of any origin, and do not apply CORS to them, so the origin is checked here.
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: h.originPatterns})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to accept websocket", slog.Any("error", err))
+		return
+	}
+	defer ws.CloseNow()
+	ws.SetReadLimit(maxMessageSize)
+
+	go func() {
+		defer cancel()
+		h.read(ctx, c, ws)
+	}()
+	h.write(ctx, c, ws)
+	ws.Close(websocket.StatusNormalClosure, "")
+}
+
+func (h *Hub) read(ctx context.Context, c *conn, ws *websocket.Conn) {
+	for {
+		var msg clientMessage
+		if err := wsjson.Read(ctx, ws, &msg); err != nil {
+			if websocket.CloseStatus(err) == -1 && ctx.Err() == nil {
+				slog.DebugContext(ctx, "failed to read live client message", slog.Any("error", err))
+			}
+			return
+		}
+		h.handle(ctx, c, msg)
+	}
+}
+
+func (h *Hub) handle(ctx context.Context, c *conn, msg clientMessage) {
+	ctx, span := telemetry.Tracer().Start(telemetry.Extract(ctx, msg.Trace), "live.receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("live.event", msg.Type),
+			attribute.String("post.id", c.postID),
+		),
+	)
+	defer span.End()
+	switch msg.Type {
+	case EventTyping:
+		data, _ := json.Marshal(typing{ClientID: c.id})
+		h.publish(ctx, Event{Type: EventTyping, PostID: c.postID, Data: data, From: c.id})
+	default:
+		span.SetStatus(codes.Error, "unknown message type")
+		slog.WarnContext(ctx, "unknown live client message", slog.String("type", msg.Type))
+	}
+}
+
+func (h *Hub) write(ctx context.Context, c *conn, ws *websocket.Conn) {
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-c.events:
+			writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+			err := wsjson.Write(writeCtx, ws, ev)
+			cancel()
+			if err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			pingCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+			err := ws.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				slog.DebugContext(ctx, "live client missed heartbeat", slog.String("client_id", c.id), slog.Any("error", err))
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"backend/internal/config"
+	"backend/internal/telemetry"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Decision is the outcome of moderating a post or a comment.
+type Decision string
+
+const (
+	Allow Decision = "allow"
+	// Flag keeps the content but lists it in the moderation queue for review.
+	Flag   Decision = "flag"
+	Reject Decision = "reject"
+)
+
+func ParseDecision(s string) (Decision, error) {
+	switch d := Decision(s); d {
+	case Allow, Flag, Reject:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown moderation decision %q", s)
+}
+
+func (d Decision) severity() int {
+	switch d {
+	case Flag:
+		return 1
+	case Reject:
+		return 2
+	}
+	return 0
+}
+
+// Content is a post or a comment submitted for moderation.
+type Content struct {
+	// Kind is "post" or "comment".
+	Kind   string `json:"kind"`
+	ID     string `json:"id"`
+	PostID string `json:"post_id,omitempty"`
+	Body   string `json:"body"`
+}
+
+// Result is a decision and the reasons for it.
+type Result struct {
+	Decision Decision `json:"decision"`
+	Reasons  []string `json:"reasons,omitempty"`
+}
+
+// Moderator decides whether content is allowed, flagged for review or rejected.
+type Moderator interface {
+	Moderate(ctx context.Context, c Content) (Result, error)
+}
+
+// Chain runs moderators in order and keeps the most severe decision with the reasons of every moderator.
+// It stops at the first rejection. A failing moderator flags the content, so that it is neither lost nor let through unreviewed.
+type Chain []Moderator
+
+func (c Chain) Moderate(ctx context.Context, content Content) (Result, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "moderation.moderate")
+	defer span.End()
+	result := Result{Decision: Allow}
+	for _, m := range c {
+		r, err := m.Moderate(ctx, content)
+		if err != nil {
+			slog.ErrorContext(ctx, "moderator failed, flagging content", slog.String("kind", content.Kind), slog.String("id", content.ID), slog.Any("error", err))
+			r = Result{Decision: Flag, Reasons: []string{"moderation unavailable"}}
+		}
+		if r.Decision.severity() > result.Decision.severity() {
+			result.Decision = r.Decision
+		}
+		result.Reasons = append(result.Reasons, r.Reasons...)
+		if result.Decision == Reject {
+			break
+		}
+	}
+	span.SetAttributes(
+		attribute.String("moderation.kind", content.Kind),
+		attribute.String("moderation.decision", string(result.Decision)),
+	)
+	return result, nil
+}
+
+// New builds the moderators enabled by the configuration. client calls the webhook.
+func New(cfg config.Moderation, client *http.Client) (Chain, error) {
+	var chain Chain
+	if len(cfg.BannedWords) > 0 {
+		chain = append(chain, NewBannedWords(cfg.BannedWords))
+	}
+	if len(cfg.Rules) > 0 {
+		rules := make(Rules, len(cfg.Rules))
+		for i, r := range cfg.Rules {
+			pattern, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("moderation rule %d: %w", i, err)
+			}
+			decision, err := ParseDecision(r.Decision)
+			if err != nil {
+				return nil, fmt.Errorf("moderation rule %d: %w", i, err)
+			}
+			rules[i] = Rule{Pattern: pattern, Decision: decision, Reason: r.Reason}
+		}
+		chain = append(chain, rules)
+	}
+	if cfg.MaxLinks > 0 {
+		chain = append(chain, LinkLimit(cfg.MaxLinks))
+	}
+	if cfg.SpamFlagScore > 0 {
+		chain = append(chain, SpamScore{FlagScore: cfg.SpamFlagScore, RejectScore: cfg.SpamRejectScore})
+	}
+	if cfg.WebhookURL != "" {
+		chain = append(chain, &Webhook{URL: cfg.WebhookURL, Client: client, Timeout: cfg.WebhookTimeout})
+	}
+	return chain, nil
+}
@@ -0,0 +1,177 @@
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// BannedWords rejects content containing any of its words as a whole word, ignoring case.
+type BannedWords struct {
+	pattern *regexp.Regexp
+}
+
+func NewBannedWords(words []string) *BannedWords {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	// Not \b, so that words ending with punctuation such as "c++" match too.
+	return &BannedWords{pattern: regexp.MustCompile(`(?i)(?:^|[^\pL\pN_])(` + strings.Join(quoted, "|") + `)(?:$|[^\pL\pN_])`)}
+}
+
+func (b *BannedWords) Moderate(ctx context.Context, c Content) (Result, error) {
+	if match := b.pattern.FindStringSubmatch(c.Body); match != nil {
+		return Result{Decision: Reject, Reasons: []string{fmt.Sprintf("banned word %q", strings.ToLower(match[1]))}}, nil
+	}
+	return Result{Decision: Allow}, nil
+}
+
+// Rule applies its decision to content matching its pattern.
+type Rule struct {
+	Pattern  *regexp.Regexp
+	Decision Decision
+	// Reason explains the decision. It defaults to the pattern.
+	Reason string
+}
+
+// Rules applies every matching rule.
+type Rules []Rule
+
+func (rules Rules) Moderate(ctx context.Context, c Content) (Result, error) {
+	result := Result{Decision: Allow}
+	for _, r := range rules {
+		if !r.Pattern.MatchString(c.Body) {
+			continue
+		}
+		if r.Decision.severity() > result.Decision.severity() {
+			result.Decision = r.Decision
+		}
+		reason := r.Reason
+		if reason == "" {
+			reason = fmt.Sprintf("matches %s", r.Pattern)
+		}
+		result.Reasons = append(result.Reasons, reason)
+	}
+	return result, nil
+}
+
+var link = regexp.MustCompile(`(?i)\bhttps?://\S+|\bwww\.\S+`)
+
+// LinkLimit flags content with more links than the limit.
+type LinkLimit int
+
+func (l LinkLimit) Moderate(ctx context.Context, c Content) (Result, error) {
+	if n := len(link.FindAllStringIndex(c.Body, -1)); n > int(l) {
+		return Result{Decision: Flag, Reasons: []string{fmt.Sprintf("%d links, at most %d allowed", n, int(l))}}, nil
+	}
+	return Result{Decision: Allow}, nil
+}
+
+// spamPhrases are typical of unsolicited advertising.
+var spamPhrases = []string{"buy now", "click here", "free money", "limited offer", "100% free", "work from home", "act now", "earn $"}
+
+// SpamScore scores content between 0 and 1 from heuristics such as shouting, repetitions, links and spam phrases.
+// Content scoring at least FlagScore is flagged and at least RejectScore is rejected.
+type SpamScore struct {
+	FlagScore   float64
+	RejectScore float64
+}
+
+func (s SpamScore) Moderate(ctx context.Context, c Content) (Result, error) {
+	score, signals := spamScore(c.Body)
+	var decision Decision
+	switch {
+	case s.RejectScore > 0 && score >= s.RejectScore:
+		decision = Reject
+	case score >= s.FlagScore:
+		decision = Flag
+	default:
+		return Result{Decision: Allow}, nil
+	}
+	return Result{Decision: decision, Reasons: []string{fmt.Sprintf("spam score %.2f: %s", score, strings.Join(signals, ", "))}}, nil
+}
+
+// spamScore combines the probabilities of its signals as independent evidence: 1 - Π(1 - p).
+func spamScore(body string) (float64, []string) {
+	var signals []string
+	notSpam := 1.0
+	add := func(signal string, p float64) {
+		signals = append(signals, signal)
+		notSpam *= 1 - p
+	}
+
+	// Links are left out of the text, as their letters and repeated parts say nothing about the writing.
+	text := link.ReplaceAllString(body, " ")
+	var letters, upper int
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters >= 12 && float64(upper)/float64(letters) > 0.7 {
+		add("shouting", 0.4)
+	}
+	if hasRepeatedRun(text, 6) {
+		add("repeated characters", 0.3)
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	if len(words) >= 6 {
+		counts := make(map[string]int, len(words))
+		top := 0
+		for _, w := range words {
+			if len(w) < 3 {
+				continue
+			}
+			counts[w]++
+			top = max(top, counts[w])
+		}
+		if float64(top)/float64(len(words)) > 0.3 {
+			add("repeated words", 0.4)
+		}
+	}
+
+	links := link.FindAllString(body, -1)
+	if len(links) > 0 {
+		add("links", math.Min(0.2*float64(len(links)), 0.6))
+		var linkLength int
+		for _, l := range links {
+			linkLength += len(l)
+		}
+		if float64(linkLength) > 0.5*float64(len(strings.TrimSpace(body))) {
+			add("mostly links", 0.4)
+		}
+	}
+
+	lower := strings.ToLower(body)
+	for _, phrase := range spamPhrases {
+		if strings.Contains(lower, phrase) {
+			add(fmt.Sprintf("%q", phrase), 0.5)
+		}
+	}
+	return 1 - notSpam, signals
+}
+
+// hasRepeatedRun reports whether a character other than a space repeats n times in a row, as in "!!!!!!".
+func hasRepeatedRun(s string, n int) bool {
+	var prev rune
+	run := 0
+	for _, r := range s {
+		if r == prev && !unicode.IsSpace(r) {
+			run++
+		} else {
+			prev, run = r, 1
+		}
+		if run >= n {
+			return true
+		}
+	}
+	return false
+}
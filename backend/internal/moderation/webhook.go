@@ -0,0 +1,54 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Webhook asks an HTTP service to moderate content.
+// The service receives the Content as JSON in a POST and answers with a Result, e.g. {"decision":"flag","reasons":["..."]}.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+	// Timeout bounds each call, so that a slow service does not hold up posting.
+	Timeout time.Duration
+}
+
+func (h *Webhook) Moderate(ctx context.Context, c Content) (Result, error) {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	body, err := json.Marshal(c)
+	if err != nil {
+		return Result{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return Result{}, fmt.Errorf("moderation webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var result Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Result{}, fmt.Errorf("decode moderation webhook response: %w", err)
+	}
+	if _, err := ParseDecision(string(result.Decision)); err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
@@ -0,0 +1,405 @@
+package post
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backend/internal/blob"
+	"backend/internal/database"
+	"backend/internal/job"
+	"backend/internal/tenant"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// thumbnailJob renders the thumbnail of an image attachment. Its payload is the attachment public ID.
+	thumbnailJob = "attachment.thumbnail"
+	// thumbnailSize bounds the width and height of thumbnails.
+	thumbnailSize = 320
+	// maxImagePixels keeps thumbnails from decoding images that would exhaust memory.
+	maxImagePixels = 40_000_000
+	// MaxAttachments is the number of files a post can have.
+	MaxAttachments = 4
+)
+
+var (
+	ErrAttachmentNotFound = errors.New("no attachment found")
+	ErrInvalidSignature   = errors.New("invalid or expired signature")
+	ErrAttachmentTooLarge = errors.New("attachment too large")
+)
+
+// Attachment is a file of a post. URL and ThumbnailURL are signed and expire.
+type Attachment struct {
+	ID           int     `db:"id" json:"-"`
+	PublicID     string  `db:"public_id" json:"id"`
+	Filename     string  `db:"filename" json:"filename"`
+	ContentType  string  `db:"content_type" json:"content_type"`
+	Size         int64   `db:"size" json:"size"`
+	BlobKey      string  `db:"blob_key" json:"-"`
+	ThumbnailKey *string `db:"thumbnail_key" json:"-"`
+	// Width and Height are those of images, once their thumbnail is rendered.
+	Width        *int   `db:"width" json:"width,omitempty"`
+	Height       *int   `db:"height" json:"height,omitempty"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+// Upload is a file attached to a new post.
+type Upload struct {
+	Filename    string
+	ContentType string
+	Size        int64
+	Content     io.Reader
+}
+
+func isImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// putUploads writes the uploads to the blob store under the post and returns their attachments.
+// The files already written are deleted if one fails.
+func (s *Store) putUploads(ctx context.Context, postPublicID string, uploads []Upload) ([]Attachment, error) {
+	if s.blobs == nil {
+		return nil, errors.New("attachments are not configured")
+	}
+	attachments := make([]Attachment, 0, len(uploads))
+	for _, u := range uploads {
+		a := Attachment{
+			PublicID:    ulid.Make().String(),
+			Filename:    u.Filename,
+			ContentType: u.ContentType,
+			Size:        u.Size,
+		}
+		a.BlobKey = fmt.Sprintf("posts/%s/%s", postPublicID, a.PublicID)
+		if err := s.blobs.Put(ctx, a.BlobKey, u.Content, u.Size, u.ContentType); err != nil {
+			s.deleteBlobs(ctx, attachmentKeys(attachments))
+			return nil, fmt.Errorf("store attachment %s: %w", u.Filename, err)
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// insertPostWithAttachments inserts the post and the rows of its attachments in one transaction and returns the post ID.
+func (s *Store) insertPostWithAttachments(ctx context.Context, post Post, moderationReasons sql.NullString) (int64, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	id, err := database.InsertID(ctx, tx, "INSERT INTO post (public_id, workspace_id, body, moderation, moderation_reasons) VALUES (?, ?, ?, ?, ?)", post.PublicID, tenant.ID(ctx), post.Body, post.Moderation, moderationReasons)
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range post.Attachments {
+		if _, err := tx.ExecContext(ctx, tx.Rebind("INSERT INTO attachment (public_id, post_id, filename, content_type, size, blob_key) VALUES (?, ?, ?, ?, ?, ?)"), a.PublicID, id, a.Filename, a.ContentType, a.Size, a.BlobKey); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+func attachmentKeys(attachments []Attachment) []string {
+	keys := make([]string, 0, len(attachments))
+	for _, a := range attachments {
+		keys = append(keys, a.BlobKey)
+		if a.ThumbnailKey != nil {
+			keys = append(keys, *a.ThumbnailKey)
+		}
+	}
+	return keys
+}
+
+// deleteBlobs removes files whose rows are gone. Failures leave orphaned files behind, so they are only logged.
+func (s *Store) deleteBlobs(ctx context.Context, keys []string) {
+	if s.blobs == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			slog.ErrorContext(ctx, "failed to delete attachment blob", slog.String("key", key), slog.Any("error", err))
+		}
+	}
+}
+
+// blobKeysOf returns the files of the attachments selected by the query, which must select blob_key and thumbnail_key.
+func (s *Store) blobKeysOf(ctx context.Context, query string, args ...any) ([]string, error) {
+	var attachments []Attachment
+	if err := s.db.SelectContext(ctx, &attachments, s.db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	return attachmentKeys(attachments), nil
+}
+
+// enqueueThumbnails asks for the thumbnails of the image attachments.
+func (s *Store) enqueueThumbnails(ctx context.Context, attachments []Attachment) {
+	for _, a := range attachments {
+		if !isImage(a.ContentType) {
+			continue
+		}
+		if err := s.jobs.Enqueue(ctx, thumbnailJob, a.PublicID); err != nil {
+			slog.ErrorContext(ctx, "failed to enqueue thumbnail", slog.String("attachment_id", a.PublicID), slog.Any("error", err))
+		}
+	}
+}
+
+// Attachments returns the attachments of the post with signed URLs.
+func (s *Store) Attachments(ctx context.Context, postPublicID string) ([]Attachment, error) {
+	attachments := []Attachment{}
+	db := s.reader(ctx)
+	if err := db.SelectContext(ctx, &attachments, db.Rebind("SELECT a.public_id, a.filename, a.content_type, a.size, a.thumbnail_key, a.width, a.height FROM attachment a JOIN post p ON p.id = a.post_id WHERE p.public_id = ? AND p.workspace_id = ? ORDER BY a.id"), postPublicID, tenant.ID(ctx)); err != nil {
+		return nil, err
+	}
+	s.signAttachments(attachments)
+	return attachments, nil
+}
+
+func (s *Store) signAttachments(attachments []Attachment) {
+	expires := s.urlWindow(time.Now()).Add(s.attachmentURLExpiry).Unix()
+	for i := range attachments {
+		a := &attachments[i]
+		a.URL = s.attachmentURL(a.PublicID, "", expires)
+		if a.ThumbnailKey != nil {
+			a.ThumbnailURL = s.attachmentURL(a.PublicID, "thumbnail", expires)
+		}
+	}
+}
+
+// urlWindow returns the start of the window URLs are signed in at t. The URLs signed in a window are the same, so
+// that the ETag of a post stays valid for the window, and they expire between half the expiry and the expiry after
+// being issued.
+func (s *Store) urlWindow(t time.Time) time.Time {
+	return t.Truncate(max(s.attachmentURLExpiry/2, time.Second))
+}
+
+// attachmentURL returns the download URL of an attachment, or of its thumbnail, signed until expires.
+func (s *Store) attachmentURL(publicID, variant string, expires int64) string {
+	path := "/ui/v1/attachments/" + publicID
+	if variant != "" {
+		path += "/" + variant
+	}
+	return fmt.Sprintf("%s?expires=%d&signature=%s", path, expires, s.attachmentSignature(publicID, variant, expires))
+}
+
+func (s *Store) attachmentSignature(publicID, variant string, expires int64) string {
+	mac := hmac.New(sha256.New, s.attachmentSecret)
+	fmt.Fprintf(mac, "%s:%s:%d", publicID, variant, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Store) verifyAttachmentURL(publicID, variant, expires, signature string) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.attachmentSignature(publicID, variant, exp)))
+}
+
+// OpenAttachment returns the file of an attachment, or its thumbnail, with its metadata.
+// The signature of the URL grants access, so the attachment can be of any workspace.
+func (s *Store) OpenAttachment(ctx context.Context, publicID string, thumbnail bool) (io.ReadCloser, int64, Attachment, error) {
+	var a Attachment
+	if err := s.db.GetContext(ctx, &a, s.db.Rebind("SELECT a.public_id, a.filename, a.content_type, a.blob_key, a.thumbnail_key FROM attachment a JOIN post p ON p.id = a.post_id WHERE a.public_id = ? AND p.deleted_at IS NULL"), publicID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, 0, Attachment{}, ErrAttachmentNotFound
+		}
+		return nil, 0, Attachment{}, err
+	}
+	key := a.BlobKey
+	if thumbnail {
+		if a.ThumbnailKey == nil {
+			return nil, 0, Attachment{}, ErrAttachmentNotFound
+		}
+		key = *a.ThumbnailKey
+		a.ContentType = "image/jpeg"
+	}
+	r, size, err := s.blobs.Get(ctx, key)
+	if errors.Is(err, blob.ErrNotFound) {
+		return nil, 0, Attachment{}, ErrAttachmentNotFound
+	}
+	return r, size, a, err
+}
+
+func (s *Store) renderThumbnail(ctx context.Context, j job.Job) error {
+	var publicID string
+	if err := j.Decode(&publicID); err != nil {
+		return err
+	}
+	var a Attachment
+	if err := s.db.GetContext(ctx, &a, s.db.Rebind("SELECT id, blob_key, thumbnail_key FROM attachment WHERE public_id = ?"), publicID); err != nil {
+		if err == sql.ErrNoRows {
+			// The post was purged since.
+			return nil
+		}
+		return err
+	}
+	if a.ThumbnailKey != nil {
+		return nil
+	}
+	r, _, err := s.blobs.Get(ctx, a.BlobKey)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	thumb, width, height, err := thumbnail(r)
+	if err != nil {
+		// Retrying does not fix a file that is not a valid image.
+		slog.WarnContext(ctx, "failed to render thumbnail", slog.String("attachment_id", publicID), slog.Any("error", err))
+		return nil
+	}
+	key := a.BlobKey + ".thumbnail.jpg"
+	if err := s.blobs.Put(ctx, key, bytes.NewReader(thumb), int64(len(thumb)), "image/jpeg"); err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.db.Rebind("UPDATE attachment SET thumbnail_key = ?, width = ?, height = ? WHERE id = ?"), key, width, height, a.ID)
+	return err
+}
+
+// thumbnail decodes an image and encodes it as a JPEG fitting in thumbnailSize, returning the original dimensions.
+func thumbnail(r io.Reader) ([]byte, int, int, error) {
+	var buf bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, 0, 0, fmt.Errorf("image of %dx%d is too large", cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(io.MultiReader(&buf, r))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, scale(src, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, 0, 0, err
+	}
+	return out.Bytes(), cfg.Width, cfg.Height, nil
+}
+
+// scale shrinks the image to fit in a square of size, averaging the source pixels covered by each thumbnail pixel.
+func scale(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	ratio := max(float64(b.Dx())/float64(size), float64(b.Dy())/float64(size), 1)
+	w, h := max(int(float64(b.Dx())/ratio), 1), max(int(float64(b.Dy())/ratio), 1)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		y0, y1 := b.Min.Y+int(float64(y)*ratio), b.Min.Y+max(int(float64(y+1)*ratio), int(float64(y)*ratio)+1)
+		for x := range w {
+			x0, x1 := b.Min.X+int(float64(x)*ratio), b.Min.X+max(int(float64(x+1)*ratio), int(float64(x)*ratio)+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < min(y1, b.Max.Y); sy++ {
+				for sx := x0; sx < min(x1, b.Max.X); sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n>>8), uint8(g/n>>8), uint8(bl/n>>8), uint8(a/n>>8)
+		}
+	}
+	return dst
+}
+
+// parseUploads opens the files of the attachments field of a multipart form, at most maxSize bytes each.
+// The caller closes them with closeUploads.
+func parseUploads(r *http.Request, maxSize int64) ([]Upload, error) {
+	headers := r.MultipartForm.File["attachments"]
+	if len(headers) > MaxAttachments {
+		return nil, fmt.Errorf("at most %d attachments are allowed", MaxAttachments)
+	}
+	uploads := make([]Upload, 0, len(headers))
+	for _, h := range headers {
+		if h.Size > maxSize {
+			closeUploads(uploads)
+			return nil, fmt.Errorf("%w: %s is larger than %d bytes", ErrAttachmentTooLarge, h.Filename, maxSize)
+		}
+		f, err := h.Open()
+		if err != nil {
+			closeUploads(uploads)
+			return nil, err
+		}
+		uploads = append(uploads, Upload{Filename: h.Filename, Size: h.Size, Content: f})
+		// The declared type cannot be trusted, so sniff it.
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			closeUploads(uploads)
+			return nil, err
+		}
+		uploads[len(uploads)-1].ContentType = http.DetectContentType(head[:n])
+	}
+	return uploads, nil
+}
+
+func closeUploads(uploads []Upload) {
+	for _, u := range uploads {
+		if c, ok := u.Content.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// Download serves an attachment, or its thumbnail, from a signed URL.
+func Download(store *Store, thumbnail bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		publicIDStr := r.PathValue("id")
+		variant := ""
+		if thumbnail {
+			variant = "thumbnail"
+		}
+		if !store.verifyAttachmentURL(publicIDStr, variant, r.URL.Query().Get("expires"), r.URL.Query().Get("signature")) {
+			http.Error(w, ErrInvalidSignature.Error(), http.StatusForbidden)
+			return
+		}
+		body, size, a, err := store.OpenAttachment(r.Context(), publicIDStr, thumbnail)
+		if err != nil {
+			if err == ErrAttachmentNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer body.Close()
+		// Only images are shown inline, so that an uploaded HTML file cannot run scripts on this origin.
+		disposition := "attachment"
+		if isImage(a.ContentType) {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", a.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "private, max-age=300")
+		if size > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		if _, err := io.Copy(w, body); err != nil {
+			// The status is already sent, so the client sees a truncated file.
+			slog.ErrorContext(r.Context(), "failed to send attachment", slog.String("attachment_id", publicIDStr), slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package post
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"backend/internal/database"
+	"backend/internal/live"
+	"backend/internal/moderation"
+	"backend/internal/tenant"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// MaxBatchSize is the largest number of posts a batch creates or deletes.
+const MaxBatchSize = 100
+
+var ErrInvalidBatch = fmt.Errorf("a batch has between 1 and %d items", MaxBatchSize)
+
+// BatchResult is the outcome of an item of a batch, at the index of the item in the request.
+// Status is the HTTP status the item would have got on its own.
+type BatchResult struct {
+	ID     string `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Post   *Post  `json:"post,omitempty"`
+}
+
+// BatchCreate inserts the posts of the bodies that moderation does not reject in one transaction, and warms their
+// caches in one round trip. Rejected bodies get a 422 result, while any other error fails the whole batch, such as
+// tenant.ErrQuotaExceeded if the posts do not all fit in the workspace.
+func (s *Store) BatchCreate(ctx context.Context, bodies []string) ([]BatchResult, error) {
+	if len(bodies) == 0 || len(bodies) > MaxBatchSize {
+		return nil, ErrInvalidBatch
+	}
+	if err := s.checkPostQuota(ctx, len(bodies)); err != nil {
+		return nil, err
+	}
+	results := make([]BatchResult, len(bodies))
+	type pending struct {
+		index   int
+		post    Post
+		reasons []string
+	}
+	var accepted []pending
+	for i, body := range bodies {
+		post := Post{PublicID: ulid.Make().String(), Body: body}
+		verdict, err := s.moderate(ctx, moderation.Content{Kind: "post", ID: post.PublicID, Body: body})
+		if errors.Is(err, ErrRejected) {
+			results[i] = BatchResult{Status: http.StatusUnprocessableEntity, Error: err.Error()}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		post.Moderation = verdict.Decision
+		accepted = append(accepted, pending{index: i, post: post, reasons: verdict.Reasons})
+	}
+	if len(accepted) == 0 {
+		return results, nil
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	posts := make([]Post, len(accepted))
+	ids := make([]int64, len(accepted))
+	for i, p := range accepted {
+		if ids[i], err = database.InsertID(ctx, tx, "INSERT INTO post (public_id, workspace_id, body, moderation, moderation_reasons) VALUES (?, ?, ?, ?, ?)", p.post.PublicID, tenant.ID(ctx), p.post.Body, p.post.Moderation, joinReasons(p.reasons)); err != nil {
+			return nil, fmt.Errorf("insert post %d: %w", p.index, err)
+		}
+		posts[i] = p.post
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.created(ctx, posts, ids)
+	for i, p := range accepted {
+		results[p.index] = BatchResult{ID: p.post.PublicID, Status: http.StatusCreated, Post: &posts[i]}
+	}
+	return results, nil
+}
+
+// BatchDelete moves the posts to the trash in one transaction and removes their caches in one round trip.
+// Posts that are not found, or repeated, get a 404 result.
+func (s *Store) BatchDelete(ctx context.Context, publicIDs []string) ([]BatchResult, error) {
+	if len(publicIDs) == 0 || len(publicIDs) > MaxBatchSize {
+		return nil, ErrInvalidBatch
+	}
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query, args, err := sqlx.In("SELECT public_id FROM post WHERE public_id IN (?) AND workspace_id = ? AND deleted_at IS NULL"+database.ForUpdate(tx), publicIDs, tenant.ID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	if err := tx.SelectContext(ctx, &found, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	if len(found) > 0 {
+		query, args, err := sqlx.In("UPDATE post SET deleted_at = CURRENT_TIMESTAMP WHERE public_id IN (?)", found)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(found) > 0 {
+		s.trashed(ctx, found...)
+	}
+
+	exists := make(map[string]bool, len(found))
+	for _, publicID := range found {
+		exists[publicID] = true
+	}
+	results := make([]BatchResult, len(publicIDs))
+	for i, publicID := range publicIDs {
+		if exists[publicID] {
+			results[i] = BatchResult{ID: publicID, Status: http.StatusNoContent}
+			// A repeated ID was deleted by its first occurrence.
+			delete(exists, publicID)
+			continue
+		}
+		results[i] = BatchResult{ID: publicID, Status: http.StatusNotFound, Error: ErrPostNotFound.Error()}
+	}
+	return results, nil
+}
+
+// BatchCreate creates the posts of {"posts":[{"body":"..."}]} and answers their results in the same order.
+func BatchCreate(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Posts []Post `json:"posts"`
+		}
+		if err := decodeJSON(w, r, store.maxBodySize, &req); err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+		bodies := make([]string, len(req.Posts))
+		for i, p := range req.Posts {
+			bodies[i] = p.Body
+		}
+		results, err := store.BatchCreate(r.Context(), bodies)
+		if err != nil {
+			if err == ErrInvalidBatch {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err == tenant.ErrQuotaExceeded {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The created posts are rendered together, then put back at their index.
+		var posts []Post
+		for _, res := range results {
+			if res.Post != nil {
+				posts = append(posts, *res.Post)
+			}
+		}
+		store.FillRenderedHTML(r.Context(), posts)
+		for i := range results {
+			if results[i].Post != nil {
+				results[i].Post, posts = &posts[0], posts[1:]
+			}
+		}
+		writeBatchResults(w, results)
+	}
+}
+
+// BatchDelete deletes the posts of {"ids":["..."]} and answers their results in the same order.
+func BatchDelete(store *Store, hub *live.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			IDs []string `json:"ids"`
+		}
+		if err := decodeJSON(w, r, store.maxBodySize, &req); err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+		results, err := store.BatchDelete(r.Context(), req.IDs)
+		if err != nil {
+			if err == ErrInvalidBatch {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, res := range results {
+			if res.Status == http.StatusNoContent {
+				hub.Publish(r.Context(), res.ID, live.EventPostDeleted, struct {
+					ID string `json:"id"`
+				}{ID: res.ID})
+			}
+		}
+		writeBatchResults(w, results)
+	}
+}
+
+func writeBatchResults(w http.ResponseWriter, results []BatchResult) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Results []BatchResult `json:"results"`
+	}{Results: results})
+}
@@ -0,0 +1,64 @@
+package post
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeMsgpack = "application/vnd.msgpack"
+)
+
+// msgpackTypes are the media types clients ask MessagePack with. The first one is registered, the others are
+// what older libraries send.
+var msgpackTypes = []string{contentTypeMsgpack, "application/msgpack", "application/x-msgpack"}
+
+// jsonRanges are the media ranges of the Accept header that include JSON, by how specific they are.
+var jsonRanges = map[string]int{"*/*": 1, "application/*": 2, contentTypeJSON: 3}
+
+// listContentType returns the encoding of a list the Accept header prefers: MessagePack if it ranks it above JSON,
+// and JSON otherwise. MessagePack is only chosen when asked for by name, never through a wildcard.
+func listContentType(accept string) string {
+	var jsonQ, msgpackQ float64
+	var jsonSpecificity int
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+		// The most specific range that includes JSON gives its quality.
+		if specificity := jsonRanges[mediaType]; specificity > jsonSpecificity {
+			jsonQ, jsonSpecificity = q, specificity
+		}
+		if slices.Contains(msgpackTypes, mediaType) {
+			msgpackQ = max(msgpackQ, q)
+		}
+	}
+	if msgpackQ > jsonQ {
+		return contentTypeMsgpack
+	}
+	return contentTypeJSON
+}
+
+// encode writes v in the content type, which is one listContentType returns. MessagePack uses the JSON field names.
+func encode(w http.ResponseWriter, contentType string, v any) error {
+	w.Header().Set("Content-Type", contentType)
+	if contentType == contentTypeMsgpack {
+		enc := msgpack.NewEncoder(w)
+		enc.SetCustomStructTag("json")
+		enc.UseCompactInts(true)
+		return enc.Encode(v)
+	}
+	return json.NewEncoder(w).Encode(v)
+}
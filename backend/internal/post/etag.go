@@ -0,0 +1,134 @@
+package post
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/markdown"
+	"backend/internal/tenant"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrPreconditionFailed = errors.New("post changed since it was read")
+
+// version is what a post and its comments and attachments were changed by. updated_at has microseconds, so two
+// edits in the same second still make two versions.
+type version struct {
+	UpdatedAt     time.Time `db:"updated_at"`
+	CommentCount  int       `db:"comment_count"`
+	LastCommentID int       `db:"last_comment_id"`
+	Flagged       int       `db:"flagged_comments"`
+	Attachments   int       `db:"attachments"`
+	Thumbnails    int       `db:"thumbnails"`
+}
+
+// postVersion reads the version of the post with q, which is the transaction of a write that must not race with it.
+// Comment IDs only grow, so the count and the last ID together change with any comment added or deleted, and
+// comments only leave the flagged state, so their count changes with every review.
+func postVersion(ctx context.Context, q sqlx.ExtContext, publicID string) (version, error) {
+	var v version
+	err := sqlx.GetContext(ctx, q, &v, q.Rebind("SELECT p.updated_at,"+
+		" (SELECT COUNT(*) FROM comment c WHERE c.post_id = p.id) AS comment_count,"+
+		" (SELECT COALESCE(MAX(c.id), 0) FROM comment c WHERE c.post_id = p.id) AS last_comment_id,"+
+		" (SELECT COUNT(*) FROM comment c WHERE c.post_id = p.id AND c.moderation = 'flag') AS flagged_comments,"+
+		" (SELECT COUNT(*) FROM attachment a WHERE a.post_id = p.id) AS attachments,"+
+		" (SELECT COUNT(a.thumbnail_key) FROM attachment a WHERE a.post_id = p.id) AS thumbnails"+
+		" FROM post p WHERE p.public_id = ? AND p.workspace_id = ? AND p.deleted_at IS NULL"), publicID, tenant.ID(ctx))
+	if err == sql.ErrNoRows {
+		return version{}, ErrPostNotFound
+	}
+	return v, err
+}
+
+func (v version) tag(publicID string) string {
+	return hashTag(publicID, v.UpdatedAt.UnixMicro(), v.CommentCount, v.LastCommentID, v.Flagged, v.Attachments, v.Thumbnails)
+}
+
+// hashTag hashes the parts into a short opaque tag.
+func hashTag(parts ...any) string {
+	h := sha256.New()
+	for _, p := range parts {
+		fmt.Fprintf(h, "%v|", p)
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+// ETag returns the strong ETag of the post as GetByID shows it, along with the preview cards of its links.
+// It is made of the version of the post, which If-Match compares, and of what else changes the response: the
+// previews fetched since, the Markdown renderer and, with attachments, the window their URLs were signed in.
+// The previews are passed in as they are read from Valkey, which a request does once.
+func (s *Store) ETag(ctx context.Context, publicID string, previews int) (string, error) {
+	v, err := postVersion(ctx, s.reader(ctx), publicID)
+	if err != nil {
+		return "", err
+	}
+	var window int64
+	if v.Attachments > 0 {
+		window = s.urlWindow(time.Now()).Unix()
+	}
+	return `"` + v.tag(publicID) + "." + hashTag(previews, markdown.Version, window) + `"`, nil
+}
+
+// checkIfMatch returns ErrPreconditionFailed unless the If-Match header lists the current version of the post.
+// An empty header always matches. Only the version part of the ETags is compared, so that an ETag read in another
+// window of signed URLs, or before a preview was fetched, still matches while the post is unchanged.
+func checkIfMatch(ctx context.Context, q sqlx.ExtContext, publicID, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	v, err := postVersion(ctx, q, publicID)
+	if err != nil {
+		return err
+	}
+	tag := v.tag(publicID)
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return nil
+		}
+		// If-Match uses the strong comparison, which weak ETags never pass.
+		if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		versionTag, _, _ := strings.Cut(strings.Trim(candidate, `"`), ".")
+		if versionTag == tag {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
+
+// ListETag returns the strong ETag of a page as List shows it in the content type. Besides the page itself, it
+// covers what List adds from elsewhere: the total, the comment counts and the preview cards.
+func ListETag(page Page, total int, contentType string) string {
+	parts := []any{contentType, page.Sort, page.HasMore, page.NextCursor, page.PrevCursor, total, markdown.Version}
+	for _, p := range page.Posts {
+		parts = append(parts, p.PublicID, p.UpdatedAt.UnixMicro(), p.CommentCount, len(p.Previews))
+	}
+	return `"` + hashTag(parts...) + `"`
+}
+
+// notModified sets the caching headers of a read and reports whether the If-None-Match header of the request
+// already lists the ETag, in which case a 304 was written.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	// Clients keep the response but ask again every time, which costs a 304 while nothing changed.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		// If-None-Match uses the weak comparison.
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
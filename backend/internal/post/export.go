@@ -0,0 +1,326 @@
+package post
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/moderation"
+	"backend/internal/tenant"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+	"github.com/valkey-io/valkey-go"
+)
+
+// ErrInvalidImport is returned by Import for lines that are not valid exported posts.
+var ErrInvalidImport = errors.New("invalid import")
+
+// exportBatchSize is the number of posts read or written per round trip by Export and Import.
+const exportBatchSize = 100
+
+// ExportedPost is a line of an NDJSON export.
+type ExportedPost struct {
+	PublicID  string            `db:"public_id" json:"id"`
+	Body      string            `db:"body" json:"body"`
+	CreatedAt time.Time         `db:"created_at" json:"created_at"`
+	EditedAt  *time.Time        `db:"edited_at" json:"edited_at,omitempty"`
+	Comments  []ExportedComment `json:"comments"`
+}
+
+type ExportedComment struct {
+	PublicID  string    `db:"public_id" json:"id"`
+	Body      string    `db:"body" json:"body"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+func (p ExportedPost) validate() error {
+	if _, err := ulid.ParseStrict(p.PublicID); err != nil {
+		return fmt.Errorf("post id %q: %w", p.PublicID, err)
+	}
+	for _, c := range p.Comments {
+		if _, err := ulid.ParseStrict(c.PublicID); err != nil {
+			return fmt.Errorf("comment id %q of post %s: %w", c.PublicID, p.PublicID, err)
+		}
+	}
+	return nil
+}
+
+// Export calls fn with every post of the workspace of ctx that is not in the trash, oldest first, together with its
+// comments.
+func (s *Store) Export(ctx context.Context, fn func(ExportedPost) error) error {
+	lastID := 0
+	for {
+		var rows []struct {
+			ID int `db:"id"`
+			ExportedPost
+		}
+		if err := s.db.SelectContext(ctx, &rows, s.db.Rebind("SELECT id, public_id, body, created_at, edited_at FROM post WHERE workspace_id = ? AND id > ? AND deleted_at IS NULL ORDER BY id LIMIT ?"), tenant.ID(ctx), lastID, exportBatchSize); err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		ids := make([]int, len(rows))
+		for i, row := range rows {
+			ids[i] = row.ID
+		}
+		query, args, err := sqlx.In("SELECT post_id, public_id, body, created_at FROM comment WHERE post_id IN (?) ORDER BY id", ids)
+		if err != nil {
+			return err
+		}
+		var comments []struct {
+			PostID int `db:"post_id"`
+			ExportedComment
+		}
+		if err := s.db.SelectContext(ctx, &comments, s.db.Rebind(query), args...); err != nil {
+			return err
+		}
+		byPost := make(map[int][]ExportedComment, len(rows))
+		for _, c := range comments {
+			byPost[c.PostID] = append(byPost[c.PostID], c.ExportedComment)
+		}
+		for _, row := range rows {
+			row.Comments = byPost[row.ID]
+			if row.Comments == nil {
+				row.Comments = []ExportedComment{}
+			}
+			if err := fn(row.ExportedPost); err != nil {
+				return err
+			}
+		}
+		lastID = rows[len(rows)-1].ID
+	}
+}
+
+// ImportResult counts what Import wrote. Posts whose public ID already exists are skipped with their comments.
+// Rejected counts the posts and comments that moderation rejected, together with the comments of rejected posts.
+type ImportResult struct {
+	Posts    int `json:"posts"`
+	Comments int `json:"comments"`
+	Skipped  int `json:"skipped"`
+	Rejected int `json:"rejected"`
+}
+
+// Import inserts the posts read from next into the workspace of ctx until it returns io.EOF, keeping their public IDs
+// and timestamps. Each batch is written in its own transaction, so a failure leaves the previous batches in place,
+// including when a batch would go over the quota of the workspace and tenant.ErrQuotaExceeded is returned.
+func (s *Store) Import(ctx context.Context, next func() (ExportedPost, error)) (ImportResult, error) {
+	var result ImportResult
+	line := 0
+	// The count is recomputed by TotalCount on the next read.
+	defer func() {
+		if err := s.vk.Do(context.WithoutCancel(ctx), s.vk.B().Del().Key(tenant.Key(ctx, "post:total_count")).Build()).Error(); err != nil {
+			slog.ErrorContext(ctx, "failed to reset total count in valkey", slog.Any("error", err))
+		}
+	}()
+	for {
+		batch := make([]ExportedPost, 0, exportBatchSize)
+		for len(batch) < exportBatchSize {
+			p, err := next()
+			if err == io.EOF {
+				break
+			}
+			line++
+			if err != nil {
+				return result, fmt.Errorf("%w: line %d: %w", ErrInvalidImport, line, err)
+			}
+			if err := p.validate(); err != nil {
+				return result, fmt.Errorf("%w: line %d: %v", ErrInvalidImport, line, err)
+			}
+			batch = append(batch, p)
+		}
+		if len(batch) == 0 {
+			return result, nil
+		}
+		if err := s.importBatch(ctx, batch, &result); err != nil {
+			return result, err
+		}
+	}
+}
+
+func (s *Store) importBatch(ctx context.Context, batch []ExportedPost, result *ImportResult) error {
+	publicIDs := make([]string, len(batch))
+	for i, p := range batch {
+		publicIDs[i] = p.PublicID
+	}
+	// Public IDs are unique across workspaces, so a post of another workspace is skipped too.
+	query, args, err := sqlx.In("SELECT public_id FROM post WHERE public_id IN (?)", publicIDs)
+	if err != nil {
+		return err
+	}
+	var existing []string
+	if err := s.db.SelectContext(ctx, &existing, s.db.Rebind(query), args...); err != nil {
+		return err
+	}
+	skip := make(map[string]bool, len(existing))
+	for _, publicID := range existing {
+		skip[publicID] = true
+	}
+	// Imported posts and comments go through moderation like new ones, before the transaction since the moderator
+	// may call a webhook.
+	type pending struct {
+		post     ExportedPost
+		verdict  moderation.Result
+		verdicts []moderation.Result
+	}
+	var accepted []pending
+	var skipped, rejected int
+	for _, p := range batch {
+		if skip[p.PublicID] {
+			skipped++
+			continue
+		}
+		// Repeated lines in the same import are skipped too.
+		skip[p.PublicID] = true
+		verdict, err := s.moderate(ctx, moderation.Content{Kind: "post", ID: p.PublicID, Body: p.Body})
+		if errors.Is(err, ErrRejected) {
+			rejected += 1 + len(p.Comments)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var kept []ExportedComment
+		var verdicts []moderation.Result
+		for _, c := range p.Comments {
+			verdict, err := s.moderate(ctx, moderation.Content{Kind: "comment", ID: c.PublicID, PostID: p.PublicID, Body: c.Body})
+			if errors.Is(err, ErrRejected) {
+				rejected++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			kept = append(kept, c)
+			verdicts = append(verdicts, verdict)
+		}
+		p.Comments = kept
+		accepted = append(accepted, pending{post: p, verdict: verdict, verdicts: verdicts})
+	}
+	// The cached total does not count the posts of the previous batches until the import ends.
+	if err := s.checkPostQuota(ctx, result.Posts+len(accepted)); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	ids := make([]int64, len(accepted))
+	var comments int
+	for i, a := range accepted {
+		p := a.post
+		id, err := database.InsertID(ctx, tx, "INSERT INTO post (public_id, workspace_id, body, created_at, edited_at, moderation, moderation_reasons) VALUES (?, ?, ?, ?, ?, ?, ?)", p.PublicID, tenant.ID(ctx), p.Body, p.CreatedAt, p.EditedAt, a.verdict.Decision, joinReasons(a.verdict.Reasons))
+		if err != nil {
+			return fmt.Errorf("insert post %s: %w", p.PublicID, err)
+		}
+		ids[i] = id
+		if len(p.Comments) == 0 {
+			continue
+		}
+		placeholders := make([]string, len(p.Comments))
+		args := make([]any, 0, len(p.Comments)*7)
+		for j, c := range p.Comments {
+			placeholders[j] = "(?, ?, ?, ?, ?, ?, ?)"
+			args = append(args, c.PublicID, tenant.ID(ctx), c.Body, id, c.CreatedAt, a.verdicts[j].Decision, joinReasons(a.verdicts[j].Reasons))
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind("INSERT INTO comment (public_id, workspace_id, body, post_id, created_at, moderation, moderation_reasons) VALUES "+strings.Join(placeholders, ", ")), args...); err != nil {
+			return fmt.Errorf("insert comments of post %s: %w", p.PublicID, err)
+		}
+		comments += len(p.Comments)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	result.Posts += len(accepted)
+	result.Comments += comments
+	result.Skipped += skipped
+	result.Rejected += rejected
+
+	var cmds valkey.Commands
+	for i, a := range accepted {
+		p := a.post
+		cmds = append(cmds,
+			s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post:%s", p.PublicID))).Value(p.Body).Build(),
+			s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post_pk:%s", p.PublicID))).Value(strconv.FormatInt(ids[i], 10)).Build(),
+			s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post:%s:comment_count", p.PublicID))).Value(strconv.Itoa(len(p.Comments))).Build(),
+		)
+		if p.EditedAt != nil {
+			cmds = append(cmds, s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post:%s:edited_at", p.PublicID))).Value(p.EditedAt.UTC().Format(time.RFC3339)).Build())
+		}
+	}
+	for i, res := range s.vk.DoMulti(ctx, cmds...) {
+		if res.Error() != nil {
+			slog.ErrorContext(ctx, "warm imported post caches in valkey", slog.Any("cmd_index", i), slog.Any("error", res.Error()))
+		}
+	}
+	return nil
+}
+
+// Export streams the feed as NDJSON, one post with its comments per line.
+func Export(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="ddfeed.ndjson"`)
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		var written int
+		err := store.Export(r.Context(), func(p ExportedPost) error {
+			if err := enc.Encode(p); err != nil {
+				return err
+			}
+			written++
+			if flusher != nil && written%exportBatchSize == 0 {
+				flusher.Flush()
+			}
+			return nil
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to export posts", slog.Int("written", written), slog.Any("error", err))
+			// Once a line is written the status is sent, and the client only sees a truncated stream.
+			if written == 0 {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+	}
+}
+
+// Import ingests an NDJSON export.
+func Import(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, store.maxImportSize))
+		result, err := store.Import(r.Context(), func() (ExportedPost, error) {
+			var p ExportedPost
+			err := dec.Decode(&p)
+			return p, err
+		})
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrInvalidImport) {
+				status = bodyErrorStatus(err)
+			} else if err == tenant.ErrQuotaExceeded {
+				status = http.StatusForbidden
+			}
+			// Batches before the failing line are kept, so tell the client how far the import went.
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(struct {
+				ImportResult
+				Error string `json:"error"`
+			}{ImportResult: result, Error: err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
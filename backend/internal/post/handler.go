@@ -1,263 +1,390 @@
 package post
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"mime"
 	"net/http"
 	"strconv"
+	"time"
 
-	"github.com/jmoiron/sqlx"
-	"github.com/oklog/ulid/v2"
-	"github.com/valkey-io/valkey-go"
+	"backend/internal/live"
+	"backend/internal/moderation"
+	"backend/internal/preview"
+	"backend/internal/tenant"
 )
 
 type Post struct {
-	PublicID     string    `db:"public_id" json:"id"`
-	Body         string    `db:"body" json:"body"`
-	Comments     []Comment `json:"comments,omitempty"`
-	CommentCount int       `json:"comment_count"`
+	PublicID string `db:"public_id" json:"id"`
+	Body     string `db:"body" json:"body"`
+	// RenderedHTML is Body rendered from Markdown and sanitised, safe to insert as HTML.
+	RenderedHTML string     `json:"rendered_html,omitempty"`
+	Comments     []Comment  `json:"comments,omitempty"`
+	CommentCount int        `db:"comment_count" json:"comment_count"`
+	EditedAt     *time.Time `db:"edited_at" json:"edited_at,omitempty"`
+	// UpdatedAt changes with any change of the row. List reads it for its ETag.
+	UpdatedAt time.Time  `db:"updated_at" json:"-"`
+	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+	// Moderation is the decision taken on the body when the post was created or edited.
+	Moderation  moderation.Decision `db:"moderation" json:"moderation,omitempty"`
+	Attachments []Attachment        `json:"attachments,omitempty"`
+	// Previews are the cards of the links in the body whose page has been fetched.
+	Previews []preview.Card `json:"previews,omitempty"`
 }
 
 type Comment struct {
 	PublicID string `db:"public_id" json:"id"`
 	Body     string `db:"body" json:"body"`
 	PostID   string `db:"post_id" json:"post_id"`
+	// Moderation is the decision taken on the body when the comment was added.
+	Moderation moderation.Decision `db:"moderation" json:"moderation,omitempty"`
 }
 
-func Create(db *sqlx.DB, vk valkey.Client) http.HandlerFunc {
+// Create accepts a JSON post, or a multipart form with a body field and attachments files.
+func Create(store *Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var post Post
-		if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		var req Post
+		var uploads []Upload
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+			// The form holds the body and the files, each up to the attachment size.
+			r.Body = http.MaxBytesReader(w, r.Body, int64(MaxAttachments+1)*store.maxAttachmentSize)
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer r.MultipartForm.RemoveAll()
+			req.Body = r.FormValue("body")
+			var err error
+			uploads, err = parseUploads(r, store.maxAttachmentSize)
+			if err != nil {
+				if errors.Is(err, ErrAttachmentTooLarge) {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer closeUploads(uploads)
+		} else if err := decodeJSON(w, r, store.maxBodySize, &req); err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
 			return
 		}
-		post.PublicID = ulid.Make().String()
-		result, err := db.ExecContext(r.Context(), "INSERT INTO post (public_id, body) VALUES (?, ?)", post.PublicID, post.Body)
+		post, err := store.Create(r.Context(), req.Body, uploads...)
 		if err != nil {
+			if errors.Is(err, ErrRejected) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			if err == tenant.ErrQuotaExceeded {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		id, err := result.LastInsertId()
-		if err == nil {
-			if err := vk.Do(r.Context(), vk.B().Set().Key(fmt.Sprintf("post_pk:%s", post.PublicID)).Value(strconv.FormatInt(id, 10)).Build()).Error(); err != nil {
-				slog.ErrorContext(r.Context(), "failed to set post pk in valkey", slog.Any("error", err))
-			}
-		} else {
-			slog.ErrorContext(r.Context(), "failed to get last insert id", slog.Any("error", err))
-		}
-		if err := vk.Do(r.Context(), vk.B().Set().Key("post:"+post.PublicID).Value(post.Body).Build()).Error(); err != nil {
-			slog.ErrorContext(r.Context(), "failed to set post in valkey", slog.Any("error", err))
-		}
-		if err := vk.Do(r.Context(), vk.B().Incr().Key("post:total_count").Build()).Error(); err != nil {
-			slog.ErrorContext(r.Context(), "failed to increment total post count in valkey", slog.Any("error", err))
-		}
+		posts := []Post{post}
+		store.FillRenderedHTML(r.Context(), posts)
+		post = posts[0]
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(post)
 	}
 }
 
-func List(db *sqlx.DB, vk valkey.Client) http.HandlerFunc {
+func List(store *Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
 		if limit < 1 || limit > 100 {
 			limit = 10
 		}
-		lastID := r.URL.Query().Get("last_id")
-		var posts []Post
-		var err error
-		if lastID == "" {
-			err = db.SelectContext(r.Context(), &posts,
-				"SELECT public_id, body FROM post ORDER BY id DESC LIMIT ?",
-				limit)
-		} else {
-			pkStr, _ := vk.Do(r.Context(), vk.B().Get().Key(fmt.Sprintf("post_pk:%s", lastID)).Build()).AsBytes()
-			postID, err := strconv.Atoi(string(pkStr))
-			if err == nil {
-				err = db.SelectContext(r.Context(), &posts,
-					"SELECT public_id, body FROM post WHERE id < ? ORDER BY id DESC LIMIT ?",
-					postID, limit)
-			} else {
-				err = db.SelectContext(r.Context(), &posts,
-					"SELECT public_id, body FROM post WHERE id < (SELECT id FROM post WHERE public_id = ?) ORDER BY id DESC LIMIT ?",
-					lastID, limit)
-			}
+		sort, err := ParseSort(r.URL.Query().Get("sort"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		page, err := store.List(r.Context(), ListOptions{
+			Limit:  limit,
+			Sort:   sort,
+			Cursor: r.URL.Query().Get("cursor"),
+			LastID: r.URL.Query().Get("last_id"),
+		})
 		if err != nil {
+			if err == ErrInvalidCursor {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		var total int
-		if count, err := vk.Do(r.Context(), vk.B().Get().Key("post:total_count").Build()).AsInt64(); err == nil {
-			total = int(count)
-		} else {
-			if err := db.GetContext(r.Context(), &total, "SELECT COUNT(*) FROM post"); err != nil {
-				slog.ErrorContext(r.Context(), "failed to get total count", slog.Any("error", err))
-			} else {
-				if err := vk.Do(r.Context(), vk.B().Set().Key("post:total_count").Value(strconv.Itoa(total)).Build()).Error(); err != nil {
-					slog.ErrorContext(r.Context(), "failed to set total count in valkey", slog.Any("error", err))
-				}
-			}
+		total, err := store.TotalCount(r.Context())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to get total count", slog.Any("error", err))
 		}
-		countKeys := make([]string, len(posts))
-		for i := range posts {
-			countKeys[i] = "post:" + posts[i].PublicID + ":comment_count"
-		}
-		if len(countKeys) > 0 {
-			if results, err := vk.Do(r.Context(), vk.B().Mget().Key(countKeys...).Build()).ToArray(); err == nil {
-				for i, result := range results {
-					if err := result.Error(); err != nil {
-						slog.ErrorContext(r.Context(), "get comment count from valkey, fallback to db", slog.Any("error", err))
-						if err := db.GetContext(r.Context(), &posts[i].CommentCount, "SELECT COUNT(*) FROM comment WHERE post_id = (SELECT id FROM post WHERE public_id = ?)", posts[i].PublicID); err != nil {
-							slog.ErrorContext(r.Context(), "failed to get comment count from db", slog.Any("error", err))
-						}
-						if err := vk.Do(r.Context(), vk.B().Set().Key(countKeys[i]).Value(strconv.Itoa(posts[i].CommentCount)).Build()).Error(); err != nil {
-							slog.ErrorContext(r.Context(), "failed to set comment count in valkey", slog.Any("error", err))
-						}
-						continue
-					}
-					if count, err := result.AsInt64(); err == nil {
-						posts[i].CommentCount = int(count)
-					}
-				}
-			}
+		if page.Sort != SortMostCommented {
+			store.FillCommentCounts(r.Context(), page.Posts)
+		}
+		store.FillPreviews(r.Context(), page.Posts)
+		contentType := listContentType(r.Header.Get("Accept"))
+		w.Header().Add("Vary", "Accept")
+		if notModified(w, r, ListETag(page, total, contentType)) {
+			return
 		}
+		store.FillRenderedHTML(r.Context(), page.Posts)
 		var nextLastPublicID string
-		if len(posts) > 0 {
-			nextLastPublicID = posts[len(posts)-1].PublicID
+		if len(page.Posts) > 0 && page.HasMore && page.Sort == SortNewest {
+			nextLastPublicID = page.Posts[len(page.Posts)-1].PublicID
 		}
 		response := struct {
 			Posts      []Post `json:"posts"`
 			Limit      int    `json:"limit"`
 			Total      int    `json:"total"`
+			Sort       Sort   `json:"sort"`
+			HasMore    bool   `json:"has_more"`
+			NextCursor string `json:"next_cursor,omitempty"`
+			PrevCursor string `json:"prev_cursor,omitempty"`
 			NextLastID string `json:"next_last_id,omitempty"`
 		}{
-			Posts:      posts,
+			Posts:      page.Posts,
 			Limit:      limit,
 			Total:      total,
+			Sort:       page.Sort,
+			HasMore:    page.HasMore,
+			NextCursor: page.NextCursor,
+			PrevCursor: page.PrevCursor,
 			NextLastID: nextLastPublicID,
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		if err := encode(w, contentType, response); err != nil {
+			slog.ErrorContext(r.Context(), "failed to encode posts", slog.Any("error", err))
+		}
 	}
 }
 
-func GetByID(db *sqlx.DB, vk valkey.Client) http.HandlerFunc {
+func GetByID(store *Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		publicIDStr := r.PathValue("id")
 		if publicIDStr == "" {
 			http.Error(w, "missing id from path", http.StatusBadRequest)
 			return
 		}
-		var post Post
-		if bytes, err := vk.Do(r.Context(), vk.B().Get().Key(fmt.Sprintf("post:%s", publicIDStr)).Build()).AsBytes(); err == nil {
-			post = Post{
-				PublicID: publicIDStr,
-				Body:     string(bytes),
-			}
-		} else {
-			if err := db.GetContext(r.Context(), &post, "SELECT body FROM post WHERE public_id = ?", publicIDStr); err != nil {
-				if err == sql.ErrNoRows {
-					http.Error(w, "no post found", http.StatusNotFound)
-					return
-				}
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		post, err := store.Get(r.Context(), publicIDStr)
+		if err != nil {
+			if err == ErrPostNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
 				return
 			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		var comments []Comment
-		if err := db.SelectContext(r.Context(), &comments, "SELECT public_id, body, post_id FROM comment WHERE post_id = (SELECT id FROM post WHERE public_id = ?)", publicIDStr); err == nil {
-			post.Comments = comments
-			post.CommentCount = len(comments)
-		} else {
-			if err == sql.ErrNoRows {
-				post.Comments = []Comment{}
-				post.CommentCount = 0
-			} else {
-				slog.ErrorContext(r.Context(), "failed to fetch comments from db", slog.Any("error", err))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		posts := []Post{post}
+		store.FillPreviews(r.Context(), posts)
+		etag, err := store.ETag(r.Context(), publicIDStr, len(posts[0].Previews))
+		if err != nil {
+			if err == ErrPostNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
 				return
 			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if notModified(w, r, etag) {
+			return
+		}
+		comments, err := store.Comments(r.Context(), publicIDStr)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to fetch comments from db", slog.Any("error", err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		countKey := fmt.Sprintf("post:%s:comment_count", publicIDStr)
-		if err := vk.Do(r.Context(), vk.B().Set().Key(countKey).Value(strconv.Itoa(post.CommentCount)).Build()).Error(); err != nil {
-			slog.ErrorContext(r.Context(), "failed to set comment count in valkey", slog.Any("error", err))
+		posts[0].Comments = comments
+		posts[0].CommentCount = len(comments)
+		store.FillRenderedHTML(r.Context(), posts)
+		post = posts[0]
+		post.Attachments, err = store.Attachments(r.Context(), publicIDStr)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to fetch attachments from db", slog.Any("error", err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(post)
 	}
 }
 
-func Delete(db *sqlx.DB, vk valkey.Client) http.HandlerFunc {
+func Delete(store *Store, hub *live.Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		publicIDStr := r.PathValue("id")
 		if publicIDStr == "" {
 			http.Error(w, "missing id from path", http.StatusBadRequest)
 			return
 		}
-		if _, err := db.ExecContext(r.Context(), "DELETE FROM post WHERE public_id = ?", publicIDStr); err != nil {
+		if err := store.Delete(r.Context(), publicIDStr, r.Header.Get("If-Match")); err != nil {
+			if err == ErrPostNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err == ErrPreconditionFailed {
+				http.Error(w, err.Error(), http.StatusPreconditionFailed)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		delKeys := []string{
-			fmt.Sprintf("post:%s", publicIDStr),
-			fmt.Sprintf("post_pk:%s", publicIDStr),
-			fmt.Sprintf("post:%s:comment_count", publicIDStr),
+		hub.Publish(r.Context(), publicIDStr, live.EventPostDeleted, struct {
+			ID string `json:"id"`
+		}{ID: publicIDStr})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Trash lists the deleted posts with the time they will be purged at.
+func Trash(store *Store, retention time.Duration) http.HandlerFunc {
+	type trashedPost struct {
+		Post
+		PurgeAt time.Time `json:"purge_at"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit < 1 || limit > 100 {
+			limit = 10
 		}
-		multi := []valkey.Completed{
-			vk.B().Del().Key(delKeys...).Build(),
-			vk.B().Decr().Key("post:total_count").Build(),
+		posts, err := store.Trash(r.Context(), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		results := vk.DoMulti(r.Context(), multi...)
-		for i, res := range results {
-			if res.Error() != nil {
-				slog.ErrorContext(r.Context(), "delete post caches from valkey", slog.Any("cmd_index", i), slog.Any("error", res.Error()))
-			}
+		trashed := make([]trashedPost, len(posts))
+		for i, post := range posts {
+			trashed[i] = trashedPost{Post: post, PurgeAt: post.DeletedAt.Add(retention)}
 		}
-		w.WriteHeader(http.StatusNoContent)
+		response := struct {
+			Posts []trashedPost `json:"posts"`
+			Limit int           `json:"limit"`
+		}{
+			Posts: trashed,
+			Limit: limit,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
 	}
 }
 
-func AddComment(db *sqlx.DB, vk valkey.Client) http.HandlerFunc {
+func Restore(store *Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		postIDStr := r.PathValue("id")
-		if postIDStr == "" {
+		publicIDStr := r.PathValue("id")
+		if publicIDStr == "" {
 			http.Error(w, "missing id from path", http.StatusBadRequest)
 			return
 		}
-		var postID int
-		pkKey := fmt.Sprintf("post_pk:%s", postIDStr)
-		if pkStr, err := vk.Do(r.Context(), vk.B().Get().Key(pkKey).Build()).AsBytes(); err == nil {
-			postID, err = strconv.Atoi(string(pkStr))
-		} else {
-			if err := db.GetContext(r.Context(), &postID, "SELECT id FROM post WHERE public_id = ?", postIDStr); err != nil {
-				if err == sql.ErrNoRows {
-					http.Error(w, "no post found", http.StatusNotFound)
-					return
-				}
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		post, err := store.Restore(r.Context(), publicIDStr)
+		if err != nil {
+			if err == ErrPostNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
 				return
 			}
-			if err := vk.Do(r.Context(), vk.B().Set().Key(pkKey).Value(strconv.Itoa(postID)).Build()).Error(); err != nil {
-				slog.ErrorContext(r.Context(), "failed to set post pk in valkey", slog.Any("error", err))
+			if err == tenant.ErrQuotaExceeded {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
 			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		var comment Comment
-		if err := json.NewDecoder(r.Body).Decode(&comment); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(post)
+	}
+}
+
+func AddComment(store *Store, hub *live.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postIDStr := r.PathValue("id")
+		if postIDStr == "" {
+			http.Error(w, "missing id from path", http.StatusBadRequest)
+			return
+		}
+		var req Comment
+		if err := decodeJSON(w, r, store.maxBodySize, &req); err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+		if store.AsyncComments(r.Context()) {
+			addCommentAsync(w, r, store, postIDStr, req.Body)
 			return
 		}
-		comment.PublicID = ulid.Make().String()
-		_, err := db.ExecContext(r.Context(), "INSERT INTO comment (public_id, body, post_id) VALUES (?, ?, ?)", comment.PublicID, comment.Body, postID)
+		comment, err := store.AddComment(r.Context(), postIDStr, req.Body)
 		if err != nil {
+			if err == ErrPostNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, ErrRejected) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if err := vk.Do(r.Context(), vk.B().Incr().Key(fmt.Sprintf("post:%s:comment_count", postIDStr)).Build()).Error(); err != nil {
-			slog.ErrorContext(r.Context(), "failed to increment comment count in valkey", slog.Any("error", err))
-		}
+		hub.Publish(r.Context(), postIDStr, live.EventCommentAdded, comment)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(comment)
 	}
 }
+
+// addCommentAsync answers 202 with the pending comment. The job persisting it publishes the live event.
+func addCommentAsync(w http.ResponseWriter, r *http.Request, store *Store, postIDStr, body string) {
+	status, err := store.AddCommentAsync(r.Context(), postIDStr, body)
+	if err != nil {
+		if err == ErrPostNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/ui/v1/posts/%s/comment/%s", postIDStr, status.PublicID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+func DeleteComment(store *Store, hub *live.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postIDStr := r.PathValue("id")
+		commentIDStr := r.PathValue("comment_id")
+		if postIDStr == "" || commentIDStr == "" {
+			http.Error(w, "missing id from path", http.StatusBadRequest)
+			return
+		}
+		if err := store.DeleteComment(r.Context(), postIDStr, commentIDStr); err != nil {
+			if err == ErrCommentNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hub.Publish(r.Context(), postIDStr, live.EventCommentDeleted, struct {
+			ID string `json:"id"`
+		}{ID: commentIDStr})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// decodeJSON decodes the JSON body of r into v, reading at most limit bytes of it.
+func decodeJSON(w http.ResponseWriter, r *http.Request, limit int64, v any) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(v)
+}
+
+// bodyErrorStatus is the status answering a request whose body could not be read: 413 Request Entity Too Large
+// when it is over its limit, and 400 Bad Request otherwise.
+func bodyErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
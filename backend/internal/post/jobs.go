@@ -0,0 +1,96 @@
+package post
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"backend/internal/job"
+	"backend/internal/live"
+	"backend/internal/moderation"
+)
+
+const (
+	// purgeJob permanently deletes a post once it has spent the retention in the trash.
+	purgeJob = "post.purge"
+	// processCommentJob persists a comment accepted by AddCommentAsync. Its payload is the Comment.
+	processCommentJob = "comment.process"
+)
+
+type purgePayload struct {
+	ID string `json:"id"`
+}
+
+func (s *Store) registerJobs() {
+	s.jobs.Handle(purgeJob, s.purge)
+	s.jobs.Handle(processCommentJob, s.processComment)
+	s.jobs.Handle(thumbnailJob, s.renderThumbnail)
+}
+
+func (s *Store) purge(ctx context.Context, j job.Job) error {
+	var payload purgePayload
+	if err := j.Decode(&payload); err != nil {
+		return err
+	}
+	// A post restored and deleted again since the job was scheduled is left to the job of its last deletion.
+	before := time.Now().Add(-s.trashRetention).UTC()
+	keys, err := s.blobKeysOf(ctx, "SELECT a.blob_key, a.thumbnail_key FROM attachment a JOIN post p ON p.id = a.post_id WHERE p.public_id = ? AND p.deleted_at <= ?", payload.ID, before)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, s.db.Rebind("DELETE FROM post WHERE public_id = ? AND deleted_at <= ?"), payload.ID, before)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		s.deleteBlobs(ctx, keys)
+		slog.InfoContext(ctx, "purged deleted post", slog.String("post_id", payload.ID))
+	}
+	return nil
+}
+
+func (s *Store) processComment(ctx context.Context, j job.Job) error {
+	var comment Comment
+	if err := j.Decode(&comment); err != nil {
+		return err
+	}
+	status := CommentStatus{Comment: comment, State: CommentAccepted}
+	postID, err := s.primaryKey(ctx, comment.PostID)
+	if errors.Is(err, ErrPostNotFound) {
+		status.State, status.Reason = CommentRejected, "the post was deleted"
+	} else if err != nil {
+		return err
+	}
+	if status.State == CommentAccepted {
+		// A job delivered again after inserting the comment only publishes it again, which clients ignore.
+		var exists bool
+		if err := s.db.GetContext(ctx, &exists, s.db.Rebind("SELECT EXISTS(SELECT 1 FROM comment WHERE public_id = ?)"), comment.PublicID); err != nil {
+			return err
+		}
+		if !exists {
+			verdict, err := s.moderate(ctx, moderation.Content{Kind: "comment", ID: comment.PublicID, PostID: comment.PostID, Body: comment.Body})
+			switch {
+			case errors.Is(err, ErrRejected):
+				status.State, status.Reason = CommentRejected, strings.Join(verdict.Reasons, "; ")
+			case err != nil:
+				return err
+			default:
+				if err := s.insertComment(ctx, postID, comment, verdict); err != nil {
+					return err
+				}
+				status.Moderation = verdict.Decision
+			}
+		}
+	}
+	if err := s.setCommentStatus(ctx, status); err != nil {
+		slog.ErrorContext(ctx, "failed to set comment status in valkey", slog.Any("error", err))
+	}
+	if status.State == CommentAccepted {
+		s.hub.Publish(ctx, comment.PostID, live.EventCommentAdded, status.Comment)
+	} else {
+		s.hub.Publish(ctx, comment.PostID, live.EventCommentRejected, status)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package post
+
+import (
+	"net/http"
+
+	"backend/internal/live"
+)
+
+// Live streams comment additions, deletions and typing indicators of a post over a WebSocket.
+func Live(store *Store, hub *live.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		publicIDStr := r.PathValue("id")
+		if publicIDStr == "" {
+			http.Error(w, "missing id from path", http.StatusBadRequest)
+			return
+		}
+		exists, err := store.Exists(r.Context(), publicIDStr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, ErrPostNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		hub.Serve(w, r, publicIDStr)
+	}
+}
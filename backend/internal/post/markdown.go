@@ -0,0 +1,59 @@
+package post
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"backend/internal/markdown"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// renderedHTMLTTL is how long the rendering of a body is cached. Bodies are hashed into the key, so an edit
+// never reads a stale rendering, and old renderings are only left to expire.
+const renderedHTMLTTL = 24 * time.Hour
+
+func renderedHTMLKey(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return "markdown:v" + markdown.Version + ":" + hex.EncodeToString(sum[:])
+}
+
+// FillRenderedHTML sets RenderedHTML of the posts from their Markdown body, rendering the bodies missing from Valkey.
+func (s *Store) FillRenderedHTML(ctx context.Context, posts []Post) {
+	if len(posts) == 0 {
+		return
+	}
+	keys := make([]string, len(posts))
+	for i := range posts {
+		keys[i] = renderedHTMLKey(posts[i].Body)
+	}
+	results, err := s.vk.Do(ctx, s.vk.B().Mget().Key(keys...).Build()).ToArray()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get rendered posts from valkey", slog.Any("error", err))
+		results = nil
+	}
+	var sets []valkey.Completed
+	for i := range posts {
+		if i < len(results) {
+			if html, err := results[i].ToString(); err == nil {
+				posts[i].RenderedHTML = html
+				continue
+			}
+		}
+		html, err := markdown.Render(posts[i].Body)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to render post", slog.String("post_id", posts[i].PublicID), slog.Any("error", err))
+			continue
+		}
+		posts[i].RenderedHTML = html
+		sets = append(sets, s.vk.B().Set().Key(keys[i]).Value(html).Ex(renderedHTMLTTL).Build())
+	}
+	for _, res := range s.vk.DoMulti(ctx, sets...) {
+		if err := res.Error(); err != nil {
+			slog.ErrorContext(ctx, "failed to cache rendered post in valkey", slog.Any("error", err))
+		}
+	}
+}
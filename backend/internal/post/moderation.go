@@ -0,0 +1,184 @@
+package post
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/live"
+	"backend/internal/moderation"
+	"backend/internal/tenant"
+)
+
+// moderate runs the moderator on the content. A rejection is returned with ErrRejected and the reasons.
+func (s *Store) moderate(ctx context.Context, c moderation.Content) (moderation.Result, error) {
+	if s.moderator == nil {
+		return moderation.Result{Decision: moderation.Allow}, nil
+	}
+	result, err := s.moderator.Moderate(ctx, c)
+	if err != nil {
+		return moderation.Result{}, err
+	}
+	if result.Decision == moderation.Reject {
+		return result, fmt.Errorf("%w: %s", ErrRejected, strings.Join(result.Reasons, "; "))
+	}
+	return result, nil
+}
+
+// joinReasons stores the reasons of a verdict one per line, or NULL without reasons.
+func joinReasons(reasons []string) sql.NullString {
+	lines := make([]string, len(reasons))
+	for i, r := range reasons {
+		lines[i] = strings.ReplaceAll(r, "\n", " ")
+	}
+	return sql.NullString{String: strings.Join(lines, "\n"), Valid: len(lines) > 0}
+}
+
+// FlaggedItem is a post or a comment waiting in the moderation queue.
+type FlaggedItem struct {
+	Kind     string `db:"kind" json:"kind"`
+	PublicID string `db:"public_id" json:"id"`
+	// PostID is the post of a comment, or the post itself.
+	PostID     string         `db:"post_id" json:"post_id"`
+	Body       string         `db:"body" json:"body"`
+	RawReasons sql.NullString `db:"moderation_reasons" json:"-"`
+	Reasons    []string       `json:"reasons"`
+	CreatedAt  time.Time      `db:"created_at" json:"created_at"`
+}
+
+// ModerationQueue returns the flagged posts and comments of the workspace of ctx, oldest first. Content of deleted posts is left out.
+func (s *Store) ModerationQueue(ctx context.Context, limit int) ([]FlaggedItem, error) {
+	items := []FlaggedItem{}
+	if err := s.db.SelectContext(ctx, &items, s.db.Rebind(`SELECT 'post' AS kind, public_id, public_id AS post_id, body, moderation_reasons, created_at FROM post WHERE workspace_id = ? AND moderation = 'flag' AND deleted_at IS NULL
+UNION ALL
+SELECT 'comment' AS kind, c.public_id, p.public_id AS post_id, c.body, c.moderation_reasons, c.created_at FROM comment c JOIN post p ON p.id = c.post_id WHERE p.workspace_id = ? AND c.moderation = 'flag' AND p.deleted_at IS NULL
+ORDER BY created_at LIMIT ?`), tenant.ID(ctx), tenant.ID(ctx), limit); err != nil {
+		return nil, err
+	}
+	for i := range items {
+		items[i].Reasons = []string{}
+		if items[i].RawReasons.Valid {
+			items[i].Reasons = strings.Split(items[i].RawReasons.String, "\n")
+		}
+	}
+	return items, nil
+}
+
+// ReviewPost settles the moderation of a flagged post. Allowing it removes it from the queue,
+// rejecting it moves it to the trash.
+func (s *Store) ReviewPost(ctx context.Context, publicID string, decision moderation.Decision) error {
+	result, err := s.db.ExecContext(ctx, s.db.Rebind("UPDATE post SET moderation = ? WHERE public_id = ? AND workspace_id = ? AND moderation = 'flag' AND deleted_at IS NULL"), decision, publicID, tenant.ID(ctx))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrPostNotFound
+	}
+	if decision == moderation.Reject {
+		return s.Delete(ctx, publicID, "")
+	}
+	return nil
+}
+
+// ReviewComment settles the moderation of a flagged comment and returns the public ID of its post.
+// Allowing it removes it from the queue, rejecting it deletes it.
+func (s *Store) ReviewComment(ctx context.Context, publicID string, decision moderation.Decision) (string, error) {
+	var postPublicID string
+	if err := s.db.GetContext(ctx, &postPublicID, s.db.Rebind("SELECT p.public_id FROM comment c JOIN post p ON p.id = c.post_id WHERE c.public_id = ? AND p.workspace_id = ? AND c.moderation = 'flag'"), publicID, tenant.ID(ctx)); err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrCommentNotFound
+		}
+		return "", err
+	}
+	if decision == moderation.Reject {
+		return postPublicID, s.DeleteComment(ctx, postPublicID, publicID)
+	}
+	result, err := s.db.ExecContext(ctx, s.db.Rebind("UPDATE comment SET moderation = ? WHERE public_id = ? AND workspace_id = ? AND moderation = 'flag'"), decision, publicID, tenant.ID(ctx))
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return "", ErrCommentNotFound
+	}
+	return postPublicID, nil
+}
+
+// ModerationQueue lists the flagged posts and comments awaiting review.
+func ModerationQueue(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit < 1 || limit > 100 {
+			limit = 50
+		}
+		items, err := store.ModerationQueue(r.Context(), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response := struct {
+			Items []FlaggedItem `json:"items"`
+		}{
+			Items: items,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Review allows or rejects a flagged post or comment, given by the kind and id path values.
+func Review(store *Store, hub *live.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		publicIDStr := r.PathValue("id")
+		if publicIDStr == "" {
+			http.Error(w, "missing id from path", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Decision moderation.Decision `json:"decision"`
+		}
+		if err := decodeJSON(w, r, store.maxBodySize, &req); err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+		if req.Decision != moderation.Allow && req.Decision != moderation.Reject {
+			http.Error(w, "decision must be allow or reject", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch r.PathValue("kind") {
+		case "posts":
+			err = store.ReviewPost(r.Context(), publicIDStr, req.Decision)
+			if err == nil && req.Decision == moderation.Reject {
+				hub.Publish(r.Context(), publicIDStr, live.EventPostDeleted, struct {
+					ID string `json:"id"`
+				}{ID: publicIDStr})
+			}
+		case "comments":
+			var postIDStr string
+			postIDStr, err = store.ReviewComment(r.Context(), publicIDStr, req.Decision)
+			if err == nil && req.Decision == moderation.Reject {
+				hub.Publish(r.Context(), postIDStr, live.EventCommentDeleted, struct {
+					ID string `json:"id"`
+				}{ID: publicIDStr})
+			}
+		default:
+			http.Error(w, "kind must be posts or comments", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			if errors.Is(err, ErrPostNotFound) || errors.Is(err, ErrCommentNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
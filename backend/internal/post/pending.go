@@ -0,0 +1,121 @@
+package post
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"backend/internal/feature"
+	"backend/internal/tenant"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/valkey-io/valkey-go"
+)
+
+// States of a comment added with AddCommentAsync.
+const (
+	CommentPending  = "pending"
+	CommentAccepted = "accepted"
+	CommentRejected = "rejected"
+)
+
+// commentStatusTTL is how long the state of an asynchronous comment is kept in Valkey.
+// Accepted comments are still found in the database afterwards.
+const commentStatusTTL = time.Hour
+
+// CommentStatus is the state of a comment submitted asynchronously.
+type CommentStatus struct {
+	Comment
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func commentStatusKey(ctx context.Context, publicID string) string {
+	return tenant.Key(ctx, fmt.Sprintf("comment:%s:status", publicID))
+}
+
+// AsyncComments reports whether new comments are persisted by a job rather than within the request.
+func (s *Store) AsyncComments(ctx context.Context) bool {
+	return s.flags.Enabled(ctx, feature.AsyncComments)
+}
+
+// AddCommentAsync accepts a comment on the post and enqueues the job persisting it.
+// The job publishes comment.added or comment.rejected, and CommentStatus tells how far it went.
+func (s *Store) AddCommentAsync(ctx context.Context, postPublicID, body string) (CommentStatus, error) {
+	if _, err := s.primaryKey(ctx, postPublicID); err != nil {
+		return CommentStatus{}, err
+	}
+	status := CommentStatus{
+		Comment: Comment{
+			PublicID: ulid.Make().String(),
+			Body:     body,
+			PostID:   postPublicID,
+		},
+		State: CommentPending,
+	}
+	// The status is set first so that polling never misses a comment the job already processed.
+	if err := s.setCommentStatus(ctx, status); err != nil {
+		return CommentStatus{}, err
+	}
+	if err := s.jobs.Enqueue(ctx, processCommentJob, status.Comment); err != nil {
+		return CommentStatus{}, err
+	}
+	return status, nil
+}
+
+func (s *Store) setCommentStatus(ctx context.Context, status CommentStatus) error {
+	raw, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return s.vk.Do(ctx, s.vk.B().Set().Key(commentStatusKey(ctx, status.PublicID)).Value(string(raw)).Ex(commentStatusTTL).Build()).Error()
+}
+
+// CommentStatus returns the state of a comment of the post, falling back to the database once its state expired from Valkey.
+func (s *Store) CommentStatus(ctx context.Context, postPublicID, commentPublicID string) (CommentStatus, error) {
+	raw, err := s.vk.Do(ctx, s.vk.B().Get().Key(commentStatusKey(ctx, commentPublicID)).Build()).AsBytes()
+	if err == nil {
+		var status CommentStatus
+		if err := json.Unmarshal(raw, &status); err == nil && status.PostID == postPublicID {
+			return status, nil
+		}
+	} else if !valkey.IsValkeyNil(err) {
+		slog.ErrorContext(ctx, "failed to get comment status from valkey", slog.Any("error", err))
+	}
+	var comment Comment
+	if err := s.db.GetContext(ctx, &comment, s.db.Rebind("SELECT public_id, body FROM comment WHERE public_id = ? AND post_id = (SELECT id FROM post WHERE public_id = ? AND workspace_id = ?)"), commentPublicID, postPublicID, tenant.ID(ctx)); err != nil {
+		if err == sql.ErrNoRows {
+			return CommentStatus{}, ErrCommentNotFound
+		}
+		return CommentStatus{}, err
+	}
+	comment.PostID = postPublicID
+	return CommentStatus{Comment: comment, State: CommentAccepted}, nil
+}
+
+// GetCommentStatus lets clients poll a comment accepted with 202 until it is accepted or rejected.
+func GetCommentStatus(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postIDStr := r.PathValue("id")
+		commentIDStr := r.PathValue("comment_id")
+		if postIDStr == "" || commentIDStr == "" {
+			http.Error(w, "missing id from path", http.StatusBadRequest)
+			return
+		}
+		status, err := store.CommentStatus(r.Context(), postIDStr, commentIDStr)
+		if err != nil {
+			if err == ErrCommentNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
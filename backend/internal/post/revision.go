@@ -0,0 +1,226 @@
+package post
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/diff"
+	"backend/internal/live"
+	"backend/internal/moderation"
+	"backend/internal/tenant"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+type Revision struct {
+	Revision  int       `db:"revision" json:"revision"`
+	Body      string    `db:"body" json:"body"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Update changes the body of the post and records the change in post_revision.
+// The first edit also records the original body as revision 1.
+// Unless ifMatch is empty, it returns ErrPreconditionFailed if the If-Match header ifMatch does not list the ETag of the post.
+func (s *Store) Update(ctx context.Context, publicID, body, ifMatch string) (Post, error) {
+	// Moderating before the transaction keeps a slow moderation webhook from holding the row lock.
+	verdict, err := s.moderate(ctx, moderation.Content{Kind: "post", ID: publicID, Body: body})
+	if err != nil {
+		return Post{}, err
+	}
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Post{}, err
+	}
+	defer tx.Rollback()
+	var current struct {
+		ID       int        `db:"id"`
+		Body     string     `db:"body"`
+		EditedAt *time.Time `db:"edited_at"`
+	}
+	if err := tx.GetContext(ctx, &current, tx.Rebind("SELECT id, body, edited_at FROM post WHERE public_id = ? AND workspace_id = ? AND deleted_at IS NULL"+database.ForUpdate(tx)), publicID, tenant.ID(ctx)); err != nil {
+		if err == sql.ErrNoRows {
+			return Post{}, ErrPostNotFound
+		}
+		return Post{}, err
+	}
+	// The row lock keeps the post from changing between the check and the update.
+	if err := checkIfMatch(ctx, tx, publicID, ifMatch); err != nil {
+		return Post{}, err
+	}
+	if current.Body == body {
+		return Post{PublicID: publicID, Body: body, EditedAt: current.EditedAt}, nil
+	}
+	var latest int
+	if err := tx.GetContext(ctx, &latest, tx.Rebind("SELECT COALESCE(MAX(revision), 0) FROM post_revision WHERE post_id = ?"), current.ID); err != nil {
+		return Post{}, err
+	}
+	if latest == 0 {
+		if _, err := tx.ExecContext(ctx, tx.Rebind("INSERT INTO post_revision (post_id, revision, body, created_at) SELECT id, 1, body, created_at FROM post WHERE id = ?"), current.ID); err != nil {
+			return Post{}, err
+		}
+		latest = 1
+	}
+	editedAt := time.Now().UTC().Truncate(time.Second)
+	if _, err := tx.ExecContext(ctx, tx.Rebind("INSERT INTO post_revision (post_id, revision, body, created_at) VALUES (?, ?, ?, ?)"), current.ID, latest+1, body, editedAt); err != nil {
+		return Post{}, err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind("UPDATE post SET body = ?, edited_at = ?, moderation = ?, moderation_reasons = ? WHERE id = ?"), body, editedAt, verdict.Decision, joinReasons(verdict.Reasons), current.ID); err != nil {
+		return Post{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Post{}, err
+	}
+	multi := []valkey.Completed{
+		s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post:%s", publicID))).Value(body).Build(),
+		s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post:%s:edited_at", publicID))).Value(editedAt.Format(time.RFC3339)).Build(),
+	}
+	for i, res := range s.vk.DoMulti(ctx, multi...) {
+		if res.Error() != nil {
+			slog.ErrorContext(ctx, "update post caches in valkey", slog.Any("cmd_index", i), slog.Any("error", res.Error()))
+		}
+	}
+	s.previews.Request(ctx, body)
+	return Post{PublicID: publicID, Body: body, EditedAt: &editedAt, Moderation: verdict.Decision}, nil
+}
+
+// Revisions returns the bodies the post went through, oldest first.
+// A post that was never edited has its current body as the only revision.
+func (s *Store) Revisions(ctx context.Context, publicID string) ([]Revision, error) {
+	var revisions []Revision
+	if err := s.db.SelectContext(ctx, &revisions, s.db.Rebind("SELECT r.revision, r.body, r.created_at FROM post_revision r JOIN post p ON p.id = r.post_id WHERE p.public_id = ? AND p.workspace_id = ? AND p.deleted_at IS NULL ORDER BY r.revision"), publicID, tenant.ID(ctx)); err != nil {
+		return nil, err
+	}
+	if len(revisions) > 0 {
+		return revisions, nil
+	}
+	var original Revision
+	if err := s.db.GetContext(ctx, &original, s.db.Rebind("SELECT 1 AS revision, body, created_at FROM post WHERE public_id = ? AND workspace_id = ? AND deleted_at IS NULL"), publicID, tenant.ID(ctx)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrPostNotFound
+		}
+		return nil, err
+	}
+	return []Revision{original}, nil
+}
+
+func Update(store *Store, hub *live.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		publicIDStr := r.PathValue("id")
+		if publicIDStr == "" {
+			http.Error(w, "missing id from path", http.StatusBadRequest)
+			return
+		}
+		var req Post
+		if err := decodeJSON(w, r, store.maxBodySize, &req); err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+		post, err := store.Update(r.Context(), publicIDStr, req.Body, r.Header.Get("If-Match"))
+		if err != nil {
+			if err == ErrPostNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, ErrRejected) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			if err == ErrPreconditionFailed {
+				http.Error(w, err.Error(), http.StatusPreconditionFailed)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The ETag lets the client chain another conditional edit.
+		if etag, err := store.ETag(r.Context(), publicIDStr, 0); err == nil {
+			w.Header().Set("ETag", etag)
+		} else {
+			slog.ErrorContext(r.Context(), "failed to get post etag", slog.Any("error", err))
+		}
+		// Live clients show the new body without fetching the post again.
+		posts := []Post{post}
+		store.FillRenderedHTML(r.Context(), posts)
+		post = posts[0]
+		hub.Publish(r.Context(), publicIDStr, live.EventPostUpdated, post)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(post)
+	}
+}
+
+func Revisions(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		publicIDStr := r.PathValue("id")
+		if publicIDStr == "" {
+			http.Error(w, "missing id from path", http.StatusBadRequest)
+			return
+		}
+		revisions, err := store.Revisions(r.Context(), publicIDStr)
+		if err != nil {
+			if err == ErrPostNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response := struct {
+			Revisions []Revision `json:"revisions"`
+		}{
+			Revisions: revisions,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// RevisionDiff returns the unified diff between the revisions given by the from and to query parameters.
+// to defaults to the latest revision and from to the one before it.
+func RevisionDiff(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		publicIDStr := r.PathValue("id")
+		if publicIDStr == "" {
+			http.Error(w, "missing id from path", http.StatusBadRequest)
+			return
+		}
+		revisions, err := store.Revisions(r.Context(), publicIDStr)
+		if err != nil {
+			if err == ErrPostNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		to := len(revisions)
+		if v := r.URL.Query().Get("to"); v != "" {
+			if to, err = strconv.Atoi(v); err != nil || to < 1 || to > len(revisions) {
+				http.Error(w, "invalid to revision", http.StatusBadRequest)
+				return
+			}
+		}
+		from := max(to-1, 1)
+		if v := r.URL.Query().Get("from"); v != "" {
+			if from, err = strconv.Atoi(v); err != nil || from < 1 || from > len(revisions) {
+				http.Error(w, "invalid from revision", http.StatusBadRequest)
+				return
+			}
+		}
+		// Revisions are numbered from 1 without gaps.
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		w.Write([]byte(diff.Unified(
+			fmt.Sprintf("revision %d", from),
+			fmt.Sprintf("revision %d", to),
+			revisions[from-1].Body,
+			revisions[to-1].Body,
+		)))
+	}
+}
@@ -0,0 +1,773 @@
+package post
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"backend/internal/blob"
+	"backend/internal/database"
+	"backend/internal/feature"
+	"backend/internal/job"
+	"backend/internal/live"
+	"backend/internal/moderation"
+	"backend/internal/preview"
+	"backend/internal/replica"
+	"backend/internal/tenant"
+	"backend/internal/webhook"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+	"github.com/valkey-io/valkey-go"
+)
+
+const purgeBatchSize = 100
+
+var (
+	ErrPostNotFound    = errors.New("no post found")
+	ErrCommentNotFound = errors.New("no comment found")
+	ErrRejected        = errors.New("rejected by moderation")
+)
+
+// Store reads and writes posts and comments in MySQL, PostgreSQL or SQLite and keeps the Valkey caches in sync.
+// It is shared by the REST handlers and the GraphQL resolvers so both produce the same queries.
+type Store struct {
+	db      *sqlx.DB
+	vk      valkey.Client
+	cursors cursorCodec
+	flags   *feature.Flags
+	jobs    *job.Queue
+	// hub receives the events of jobs, which have no handler to publish them.
+	hub       *live.Hub
+	moderator moderation.Moderator
+	webhooks  *webhook.Dispatcher
+	// trashRetention is how long deleted posts are kept before being purged.
+	trashRetention time.Duration
+	blobs          blob.Store
+	// attachmentSecret signs the download URLs of attachments, which are valid for attachmentURLExpiry.
+	attachmentSecret    []byte
+	attachmentURLExpiry time.Duration
+	maxAttachmentSize   int64
+	maxBodySize         int64
+	maxImportSize       int64
+	previews            *preview.Fetcher
+	quotas              *tenant.Quotas
+	replicas            *replica.Pool
+}
+
+type Options struct {
+	// CursorSecret signs pagination cursors. Without a secret, a random one is used and cursors only work against this process.
+	CursorSecret   []byte
+	TrashRetention time.Duration
+	// Moderator checks posts and comments before they are written. Nil allows everything.
+	Moderator moderation.Moderator
+	// Webhooks is notified of new posts and comments and of deleted posts. It may be nil.
+	Webhooks *webhook.Dispatcher
+	// Blobs keeps the files attached to posts. Without it, posts cannot have attachments.
+	Blobs blob.Store
+	// AttachmentSecret signs the download URLs of attachments. Without a secret, a random one is used and URLs only work against this process.
+	AttachmentSecret    []byte
+	AttachmentURLExpiry time.Duration
+	// MaxAttachmentSize is the size in bytes a single attachment may have.
+	MaxAttachmentSize int64
+	// MaxBodySize is the size in bytes a JSON request body may have, and MaxImportSize the size of an import.
+	MaxBodySize   int64
+	MaxImportSize int64
+	// Previews fetches the previews of the links in posts. It may be nil.
+	Previews *preview.Fetcher
+	// Quotas limit the posts of each workspace. Nil limits nothing.
+	Quotas *tenant.Quotas
+	// Replicas serve the reads of List and GetByID. Nil reads everything from db.
+	Replicas *replica.Pool
+}
+
+// NewStore returns a Store and registers the handlers of its jobs on jobs.
+// flags switch between the alternate query paths of List and FillCommentCounts.
+func NewStore(db *sqlx.DB, vk valkey.Client, flags *feature.Flags, jobs *job.Queue, hub *live.Hub, opts Options) *Store {
+	cursorSecret := opts.CursorSecret
+	if len(cursorSecret) == 0 {
+		slog.Warn("no cursor secret configured, pagination cursors will not survive a restart")
+		cursorSecret = make([]byte, 32)
+		rand.Read(cursorSecret)
+	}
+	attachmentSecret := opts.AttachmentSecret
+	if len(attachmentSecret) == 0 && opts.Blobs != nil {
+		slog.Warn("no attachment URL secret configured, attachment URLs will not survive a restart")
+		attachmentSecret = make([]byte, 32)
+		rand.Read(attachmentSecret)
+	}
+	s := &Store{
+		db:                  db,
+		vk:                  vk,
+		cursors:             cursorCodec{secret: cursorSecret},
+		flags:               flags,
+		jobs:                jobs,
+		hub:                 hub,
+		moderator:           opts.Moderator,
+		webhooks:            opts.Webhooks,
+		trashRetention:      opts.TrashRetention,
+		blobs:               opts.Blobs,
+		attachmentSecret:    attachmentSecret,
+		attachmentURLExpiry: opts.AttachmentURLExpiry,
+		maxAttachmentSize:   opts.MaxAttachmentSize,
+		maxBodySize:         opts.MaxBodySize,
+		maxImportSize:       opts.MaxImportSize,
+		previews:            opts.Previews,
+		quotas:              opts.Quotas,
+		replicas:            opts.Replicas,
+	}
+	s.registerJobs()
+	return s
+}
+
+// Create inserts a post with its attachments in the workspace of ctx and warms the caches used by List, GetByID and
+// AddComment. It returns ErrRejected if moderation rejects the body, and tenant.ErrQuotaExceeded if the workspace
+// is full.
+func (s *Store) Create(ctx context.Context, body string, uploads ...Upload) (Post, error) {
+	if err := s.checkPostQuota(ctx, 1); err != nil {
+		return Post{}, err
+	}
+	post := Post{
+		PublicID: ulid.Make().String(),
+		Body:     body,
+	}
+	verdict, err := s.moderate(ctx, moderation.Content{Kind: "post", ID: post.PublicID, Body: body})
+	if err != nil {
+		return Post{}, err
+	}
+	post.Moderation = verdict.Decision
+	var id int64
+	if len(uploads) == 0 {
+		id, err = database.InsertID(ctx, s.db, "INSERT INTO post (public_id, workspace_id, body, moderation, moderation_reasons) VALUES (?, ?, ?, ?, ?)", post.PublicID, tenant.ID(ctx), post.Body, post.Moderation, joinReasons(verdict.Reasons))
+		if err != nil {
+			return Post{}, err
+		}
+	} else {
+		// The files are written first so that no row points to a missing file.
+		post.Attachments, err = s.putUploads(ctx, post.PublicID, uploads)
+		if err != nil {
+			return Post{}, err
+		}
+		id, err = s.insertPostWithAttachments(ctx, post, joinReasons(verdict.Reasons))
+		if err != nil {
+			s.deleteBlobs(ctx, attachmentKeys(post.Attachments))
+			return Post{}, err
+		}
+		s.signAttachments(post.Attachments)
+		s.enqueueThumbnails(ctx, post.Attachments)
+	}
+	s.created(ctx, []Post{post}, []int64{id})
+	return post, nil
+}
+
+// created warms the caches of new posts in one round trip, requests their link previews and notifies the webhooks.
+// ids are the primary keys of the posts, 0 when it is unknown.
+func (s *Store) created(ctx context.Context, posts []Post, ids []int64) {
+	cmds := make(valkey.Commands, 0, len(posts)*2+1)
+	for i, post := range posts {
+		if ids[i] != 0 {
+			cmds = append(cmds, s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post_pk:%s", post.PublicID))).Value(strconv.FormatInt(ids[i], 10)).Build())
+		}
+		cmds = append(cmds, s.vk.B().Set().Key(tenant.Key(ctx, "post:"+post.PublicID)).Value(post.Body).Build())
+	}
+	cmds = append(cmds, s.vk.B().Incrby().Key(tenant.Key(ctx, "post:total_count")).Increment(int64(len(posts))).Build())
+	for i, res := range s.vk.DoMulti(ctx, cmds...) {
+		if res.Error() != nil {
+			slog.ErrorContext(ctx, "warm post caches in valkey", slog.Any("cmd_index", i), slog.Any("error", res.Error()))
+		}
+	}
+	for _, post := range posts {
+		s.previews.Request(ctx, post.Body)
+		s.webhooks.Notify(ctx, webhook.EventPostCreated, post)
+	}
+}
+
+type ListOptions struct {
+	Limit int
+	Sort  Sort
+	// Cursor is a token from a previous Page. It takes precedence over Sort and LastID.
+	Cursor string
+	// LastID lists the posts older than this post, as the next_last_id pagination did.
+	LastID string
+}
+
+type Page struct {
+	Posts      []Post
+	Sort       Sort
+	HasMore    bool
+	NextCursor string
+	PrevCursor string
+}
+
+// List returns a page of the posts of the workspace of ctx in the requested order.
+// One extra post is fetched to know whether another page follows in the direction of travel.
+// Comment counts are filled only when sorting by most_commented, see FillCommentCounts.
+func (s *Store) List(ctx context.Context, opts ListOptions) (Page, error) {
+	var cur *cursor
+	switch {
+	case opts.Cursor != "":
+		c, err := s.cursors.decode(opts.Cursor)
+		if err != nil {
+			return Page{}, err
+		}
+		cur = &c
+		opts.Sort = c.Sort
+	case opts.LastID != "":
+		cur = &cursor{Sort: SortNewest, ID: opts.LastID}
+		opts.Sort = SortNewest
+	case opts.Sort == "":
+		opts.Sort = SortNewest
+	}
+	backward := cur != nil && cur.Backward
+	// newest and most_commented walk the rows in descending order, oldest in ascending order.
+	// Going backward walks the other way and the page is reversed afterwards.
+	desc := (opts.Sort != SortOldest) != backward
+	cmp, order := ">", "ASC"
+	if desc {
+		cmp, order = "<", "DESC"
+	}
+
+	var query string
+	var args []any
+	var anchor string
+	if cur != nil {
+		anchor, args = s.anchor(ctx, cur.ID)
+	}
+	switch opts.Sort {
+	case SortMostCommented:
+		query = "SELECT p.public_id, p.body, p.edited_at, p.updated_at, COUNT(c.id) AS comment_count FROM post p LEFT JOIN comment c ON c.post_id = p.id WHERE p.workspace_id = ? AND p.deleted_at IS NULL GROUP BY p.id"
+		if cur != nil {
+			// PostgreSQL does not take the comment_count alias in HAVING.
+			query += " HAVING (COUNT(c.id), p.id) " + cmp + " (?, " + anchor + ")"
+			args = append([]any{cur.Count}, args...)
+		}
+		query += " ORDER BY comment_count " + order + ", p.id " + order + " LIMIT ?"
+	default:
+		query = "SELECT public_id, body, edited_at, updated_at FROM post WHERE workspace_id = ? AND deleted_at IS NULL"
+		if cur != nil {
+			query += " AND id " + cmp + " " + anchor
+		}
+		query += " ORDER BY id " + order + " LIMIT ?"
+	}
+	args = append([]any{tenant.ID(ctx)}, args...)
+	args = append(args, opts.Limit+1)
+
+	var posts []Post
+	db := s.reader(ctx)
+	if err := db.SelectContext(ctx, &posts, db.Rebind(query), args...); err != nil {
+		return Page{}, err
+	}
+	hasMore := len(posts) > opts.Limit
+	if hasMore {
+		posts = posts[:opts.Limit]
+	}
+	if backward {
+		slices.Reverse(posts)
+	}
+
+	page := Page{Posts: posts, Sort: opts.Sort}
+	if len(posts) == 0 {
+		return page, nil
+	}
+	// Going forward, the posts before the anchor are those we came from, and vice versa.
+	hasNext, hasPrev := hasMore, cur != nil
+	if backward {
+		hasNext, hasPrev = true, hasMore
+	}
+	if hasNext {
+		last := posts[len(posts)-1]
+		page.NextCursor = s.cursors.encode(cursor{Sort: opts.Sort, ID: last.PublicID, Count: last.CommentCount})
+	}
+	if hasPrev {
+		first := posts[0]
+		page.PrevCursor = s.cursors.encode(cursor{Sort: opts.Sort, ID: first.PublicID, Count: first.CommentCount, Backward: true})
+	}
+	page.HasMore = hasNext
+	return page, nil
+}
+
+// anchor returns the SQL expression and arguments for the primary key of a cursor post.
+// The key comes from the post_pk cache when possible, saving a subquery on the post table.
+func (s *Store) anchor(ctx context.Context, publicID string) (string, []any) {
+	if s.flags.Enabled(ctx, feature.ListPostPKCache) {
+		pkStr, _ := s.vk.Do(ctx, s.vk.B().Get().Key(tenant.Key(ctx, fmt.Sprintf("post_pk:%s", publicID))).Build()).AsBytes()
+		if postID, err := strconv.Atoi(string(pkStr)); err == nil {
+			return "?", []any{postID}
+		}
+	}
+	return "(SELECT id FROM post WHERE public_id = ?)", []any{publicID}
+}
+
+// TotalCount returns the number of posts of the workspace of ctx, from Valkey when possible.
+// A cache miss is counted on the primary, since writes then increment the cached count rather than recount it.
+func (s *Store) TotalCount(ctx context.Context) (int, error) {
+	key := tenant.Key(ctx, "post:total_count")
+	if count, err := s.vk.Do(ctx, s.vk.B().Get().Key(key).Build()).AsInt64(); err == nil {
+		return int(count), nil
+	}
+	var total int
+	if err := s.db.GetContext(ctx, &total, s.db.Rebind("SELECT COUNT(*) FROM post WHERE workspace_id = ? AND deleted_at IS NULL"), tenant.ID(ctx)); err != nil {
+		return 0, err
+	}
+	if err := s.vk.Do(ctx, s.vk.B().Set().Key(key).Value(strconv.Itoa(total)).Build()).Error(); err != nil {
+		slog.ErrorContext(ctx, "failed to set total count in valkey", slog.Any("error", err))
+	}
+	return total, nil
+}
+
+// FillCommentCounts sets CommentCount of the posts from Valkey, falling back to the database on cache misses.
+func (s *Store) FillCommentCounts(ctx context.Context, posts []Post) {
+	if len(posts) == 0 {
+		return
+	}
+	if !s.flags.Enabled(ctx, feature.CommentCountCache) {
+		s.countComments(ctx, posts)
+		return
+	}
+	countKeys := make([]string, len(posts))
+	for i := range posts {
+		countKeys[i] = tenant.Key(ctx, "post:"+posts[i].PublicID+":comment_count")
+	}
+	results, err := s.vk.Do(ctx, s.vk.B().Mget().Key(countKeys...).Build()).ToArray()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get comment counts from valkey", slog.Any("error", err))
+		return
+	}
+	for i, result := range results {
+		if err := result.Error(); err != nil {
+			slog.ErrorContext(ctx, "get comment count from valkey, fallback to db", slog.Any("error", err))
+			if err := s.commentCount(ctx, &posts[i]); err != nil {
+				slog.ErrorContext(ctx, "failed to get comment count from db", slog.Any("error", err))
+			}
+			if err := s.vk.Do(ctx, s.vk.B().Set().Key(countKeys[i]).Value(strconv.Itoa(posts[i].CommentCount)).Build()).Error(); err != nil {
+				slog.ErrorContext(ctx, "failed to set comment count in valkey", slog.Any("error", err))
+			}
+			continue
+		}
+		if count, err := result.AsInt64(); err == nil {
+			posts[i].CommentCount = int(count)
+		}
+	}
+}
+
+// FillPreviews sets Previews of the posts from the cached link previews.
+// Links without a cached preview are fetched in the background and show up on a later read.
+func (s *Store) FillPreviews(ctx context.Context, posts []Post) {
+	urls := make([][]string, len(posts))
+	var all []string
+	for i := range posts {
+		urls[i] = preview.URLs(posts[i].Body)
+		all = append(all, urls[i]...)
+	}
+	cards := s.previews.Cards(ctx, all)
+	for i := range posts {
+		for _, u := range urls[i] {
+			if card, ok := cards[u]; ok {
+				posts[i].Previews = append(posts[i].Previews, card)
+			}
+		}
+	}
+}
+
+// commentCount counts the comments of a post in the database. It reads the primary, since the count is cached and then
+// incremented by writes.
+func (s *Store) commentCount(ctx context.Context, post *Post) error {
+	if s.flags.Enabled(ctx, feature.SubqueryFallback) {
+		return s.db.GetContext(ctx, &post.CommentCount, s.db.Rebind("SELECT COUNT(*) FROM comment WHERE post_id = (SELECT id FROM post WHERE public_id = ?)"), post.PublicID)
+	}
+	postID, err := s.primaryKey(ctx, post.PublicID)
+	if err != nil {
+		return err
+	}
+	return s.db.GetContext(ctx, &post.CommentCount, s.db.Rebind("SELECT COUNT(*) FROM comment WHERE post_id = ?"), postID)
+}
+
+// countComments sets CommentCount of the posts with a single query, bypassing Valkey.
+func (s *Store) countComments(ctx context.Context, posts []Post) {
+	publicIDs := make([]string, len(posts))
+	for i := range posts {
+		publicIDs[i] = posts[i].PublicID
+	}
+	query, args, err := sqlx.In("SELECT p.public_id, COUNT(c.id) AS comment_count FROM post p LEFT JOIN comment c ON c.post_id = p.id WHERE p.public_id IN (?) GROUP BY p.id", publicIDs)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to build comment count query", slog.Any("error", err))
+		return
+	}
+	var rows []struct {
+		PublicID     string `db:"public_id"`
+		CommentCount int    `db:"comment_count"`
+	}
+	db := s.reader(ctx)
+	if err := db.SelectContext(ctx, &rows, db.Rebind(query), args...); err != nil {
+		slog.ErrorContext(ctx, "failed to get comment counts from db", slog.Any("error", err))
+		return
+	}
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.PublicID] = row.CommentCount
+	}
+	for i := range posts {
+		posts[i].CommentCount = counts[posts[i].PublicID]
+	}
+}
+
+// Get returns the post without its comments, from Valkey when possible.
+func (s *Store) Get(ctx context.Context, publicID string) (Post, error) {
+	if results, err := s.vk.Do(ctx, s.vk.B().Mget().Key(tenant.Key(ctx, fmt.Sprintf("post:%s", publicID)), tenant.Key(ctx, fmt.Sprintf("post:%s:edited_at", publicID))).Build()).ToArray(); err == nil {
+		if body, err := results[0].ToString(); err == nil {
+			post := Post{
+				PublicID: publicID,
+				Body:     body,
+			}
+			if v, err := results[1].ToString(); err == nil {
+				if editedAt, err := time.Parse(time.RFC3339, v); err == nil {
+					post.EditedAt = &editedAt
+				}
+			}
+			return post, nil
+		}
+	}
+	var post Post
+	db := s.reader(ctx)
+	if err := db.GetContext(ctx, &post, db.Rebind("SELECT public_id, body, edited_at FROM post WHERE public_id = ? AND workspace_id = ? AND deleted_at IS NULL"), publicID, tenant.ID(ctx)); err != nil {
+		if err == sql.ErrNoRows {
+			return Post{}, ErrPostNotFound
+		}
+		return Post{}, err
+	}
+	return post, nil
+}
+
+// Exists reports whether the post exists.
+func (s *Store) Exists(ctx context.Context, publicID string) (bool, error) {
+	if n, err := s.vk.Do(ctx, s.vk.B().Exists().Key(tenant.Key(ctx, fmt.Sprintf("post:%s", publicID))).Build()).AsInt64(); err == nil && n > 0 {
+		return true, nil
+	}
+	if _, err := s.primaryKey(ctx, publicID); err != nil {
+		if err == ErrPostNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Comments returns the comments of the post and refreshes its cached comment count, unless they were read from a
+// replica that may lag behind the writes the count has seen.
+func (s *Store) Comments(ctx context.Context, publicID string) ([]Comment, error) {
+	comments := []Comment{}
+	db := s.reader(ctx)
+	if err := db.SelectContext(ctx, &comments, db.Rebind("SELECT public_id, body, post_id FROM comment WHERE post_id = (SELECT id FROM post WHERE public_id = ? AND workspace_id = ?)"), publicID, tenant.ID(ctx)); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if db != s.db {
+		return comments, nil
+	}
+	countKey := tenant.Key(ctx, fmt.Sprintf("post:%s:comment_count", publicID))
+	if err := s.vk.Do(ctx, s.vk.B().Set().Key(countKey).Value(strconv.Itoa(len(comments))).Build()).Error(); err != nil {
+		slog.ErrorContext(ctx, "failed to set comment count in valkey", slog.Any("error", err))
+	}
+	return comments, nil
+}
+
+// CommentsByPosts returns the comments of several posts with a single query, keyed by post public ID.
+func (s *Store) CommentsByPosts(ctx context.Context, publicIDs []string) (map[string][]Comment, error) {
+	byPost := make(map[string][]Comment, len(publicIDs))
+	if len(publicIDs) == 0 {
+		return byPost, nil
+	}
+	query, args, err := sqlx.In("SELECT c.public_id, c.body, c.post_id, p.public_id AS post_public_id FROM comment c JOIN post p ON p.id = c.post_id WHERE p.public_id IN (?) AND p.workspace_id = ? ORDER BY c.id", publicIDs, tenant.ID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Comment
+		PostPublicID string `db:"post_public_id"`
+	}
+	db := s.reader(ctx)
+	if err := db.SelectContext(ctx, &rows, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		byPost[row.PostPublicID] = append(byPost[row.PostPublicID], row.Comment)
+	}
+	return byPost, nil
+}
+
+// Delete moves the post to the trash and removes its caches.
+// The post and its comments stay in the database until PurgeDeleted hard-deletes them.
+// A non-empty ifMatch is the If-Match header the post must match, see checkIfMatch.
+func (s *Store) Delete(ctx context.Context, publicID, ifMatch string) error {
+	if err := s.trash(ctx, publicID, ifMatch); err != nil {
+		return err
+	}
+	s.trashed(ctx, publicID)
+	return nil
+}
+
+// trashed removes the caches of posts moved to the trash in one round trip, schedules their purge and notifies the
+// webhooks.
+func (s *Store) trashed(ctx context.Context, publicIDs ...string) {
+	delKeys := make([]string, 0, len(publicIDs)*4)
+	for _, publicID := range publicIDs {
+		delKeys = append(delKeys,
+			tenant.Key(ctx, fmt.Sprintf("post:%s", publicID)),
+			tenant.Key(ctx, fmt.Sprintf("post_pk:%s", publicID)),
+			tenant.Key(ctx, fmt.Sprintf("post:%s:comment_count", publicID)),
+			tenant.Key(ctx, fmt.Sprintf("post:%s:edited_at", publicID)),
+		)
+	}
+	multi := []valkey.Completed{
+		s.vk.B().Del().Key(delKeys...).Build(),
+		s.vk.B().Decrby().Key(tenant.Key(ctx, "post:total_count")).Decrement(int64(len(publicIDs))).Build(),
+	}
+	results := s.vk.DoMulti(ctx, multi...)
+	for i, res := range results {
+		if res.Error() != nil {
+			slog.ErrorContext(ctx, "delete post caches from valkey", slog.Any("cmd_index", i), slog.Any("error", res.Error()))
+		}
+	}
+	purgeAt := time.Now().Add(s.trashRetention)
+	for _, publicID := range publicIDs {
+		if err := s.jobs.Schedule(ctx, purgeJob, purgePayload{ID: publicID}, purgeAt); err != nil {
+			// RunPurger catches up with the posts whose purge job was lost.
+			slog.ErrorContext(ctx, "failed to schedule post purge", slog.Any("error", err))
+		}
+		s.webhooks.Notify(ctx, webhook.EventPostDeleted, struct {
+			ID string `json:"id"`
+		}{ID: publicID})
+	}
+}
+
+// trash sets deleted_at of the post. With ifMatch, the post is locked while its version is compared.
+func (s *Store) trash(ctx context.Context, publicID, ifMatch string) error {
+	const query = "UPDATE post SET deleted_at = CURRENT_TIMESTAMP WHERE public_id = ? AND workspace_id = ? AND deleted_at IS NULL"
+	if ifMatch == "" {
+		result, err := s.db.ExecContext(ctx, s.db.Rebind(query), publicID, tenant.ID(ctx))
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return ErrPostNotFound
+		}
+		return nil
+	}
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var id int
+	err = tx.GetContext(ctx, &id, tx.Rebind("SELECT id FROM post WHERE public_id = ? AND workspace_id = ? AND deleted_at IS NULL"+database.ForUpdate(tx)), publicID, tenant.ID(ctx))
+	if err == sql.ErrNoRows {
+		return ErrPostNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkIfMatch(ctx, tx, publicID, ifMatch); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), publicID, tenant.ID(ctx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Trash returns up to limit deleted posts of the workspace of ctx, most recently deleted first.
+func (s *Store) Trash(ctx context.Context, limit int) ([]Post, error) {
+	posts := []Post{}
+	err := s.db.SelectContext(ctx, &posts,
+		s.db.Rebind("SELECT p.public_id, p.body, p.deleted_at, COUNT(c.id) AS comment_count FROM post p LEFT JOIN comment c ON c.post_id = p.id WHERE p.workspace_id = ? AND p.deleted_at IS NOT NULL GROUP BY p.id ORDER BY p.deleted_at DESC, p.id DESC LIMIT ?"),
+		tenant.ID(ctx), limit)
+	return posts, err
+}
+
+// Restore takes the post out of the trash and rebuilds the caches Delete removed.
+// It returns tenant.ErrQuotaExceeded if the workspace is full.
+func (s *Store) Restore(ctx context.Context, publicID string) (Post, error) {
+	if err := s.checkPostQuota(ctx, 1); err != nil {
+		return Post{}, err
+	}
+	result, err := s.db.ExecContext(ctx, s.db.Rebind("UPDATE post SET deleted_at = NULL WHERE public_id = ? AND workspace_id = ? AND deleted_at IS NOT NULL"), publicID, tenant.ID(ctx))
+	if err != nil {
+		return Post{}, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return Post{}, ErrPostNotFound
+	}
+	var row struct {
+		ID int `db:"id"`
+		Post
+	}
+	if err := s.db.GetContext(ctx, &row, s.db.Rebind("SELECT p.id, p.public_id, p.body, p.edited_at, COUNT(c.id) AS comment_count FROM post p LEFT JOIN comment c ON c.post_id = p.id WHERE p.public_id = ? GROUP BY p.id"), publicID); err != nil {
+		return Post{}, err
+	}
+	multi := []valkey.Completed{
+		s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post:%s", publicID))).Value(row.Body).Build(),
+		s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post_pk:%s", publicID))).Value(strconv.Itoa(row.ID)).Build(),
+		s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post:%s:comment_count", publicID))).Value(strconv.Itoa(row.CommentCount)).Build(),
+		s.vk.B().Incr().Key(tenant.Key(ctx, "post:total_count")).Build(),
+	}
+	if row.EditedAt != nil {
+		multi = append(multi, s.vk.B().Set().Key(tenant.Key(ctx, fmt.Sprintf("post:%s:edited_at", publicID))).Value(row.EditedAt.Format(time.RFC3339)).Build())
+	}
+	for i, res := range s.vk.DoMulti(ctx, multi...) {
+		if res.Error() != nil {
+			slog.ErrorContext(ctx, "restore post caches in valkey", slog.Any("cmd_index", i), slog.Any("error", res.Error()))
+		}
+	}
+	return row.Post, nil
+}
+
+// PurgeDeleted hard-deletes up to limit posts of any workspace that have been in the trash for longer than retention.
+// Their comments go with them through the foreign key cascade.
+// The caches and post:total_count were already updated by Delete.
+// The files of their attachments are deleted afterwards.
+func (s *Store) PurgeDeleted(ctx context.Context, retention time.Duration, limit int) (int64, error) {
+	before := time.Now().Add(-retention).UTC()
+	// Both statements order by id too, so that they pick the same posts.
+	keys, err := s.blobKeysOf(ctx, "SELECT a.blob_key, a.thumbnail_key FROM attachment a JOIN (SELECT id FROM post WHERE deleted_at < ? ORDER BY deleted_at, id LIMIT ?) p ON p.id = a.post_id", before, limit)
+	if err != nil {
+		return 0, err
+	}
+	query := "DELETE FROM post WHERE deleted_at < ? ORDER BY deleted_at, id LIMIT ?"
+	if s.db.DriverName() != database.MySQL {
+		// PostgreSQL and SQLite have no ORDER BY or LIMIT in DELETE.
+		query = "DELETE FROM post WHERE id IN (SELECT id FROM post WHERE deleted_at < ? ORDER BY deleted_at, id LIMIT ?)"
+	}
+	result, err := s.db.ExecContext(ctx, s.db.Rebind(query), before, limit)
+	if err != nil {
+		return 0, err
+	}
+	s.deleteBlobs(ctx, keys)
+	return result.RowsAffected()
+}
+
+// RunPurger calls PurgeDeleted every interval until ctx is done.
+// Deleting a post schedules a job purging it, so this only sweeps the posts whose job was lost.
+func (s *Store) RunPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			n, err := s.PurgeDeleted(ctx, s.trashRetention, purgeBatchSize)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to purge deleted posts", slog.Any("error", err))
+				break
+			}
+			if n > 0 {
+				slog.InfoContext(ctx, "purged deleted posts", slog.Int64("count", n))
+			}
+			if n < purgeBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// AddComment inserts a comment on the post and increments its cached comment count.
+// It returns ErrRejected if moderation rejects the body.
+func (s *Store) AddComment(ctx context.Context, postPublicID, body string) (Comment, error) {
+	postID, err := s.primaryKey(ctx, postPublicID)
+	if err != nil {
+		return Comment{}, err
+	}
+	comment := Comment{
+		PublicID: ulid.Make().String(),
+		Body:     body,
+		PostID:   postPublicID,
+	}
+	verdict, err := s.moderate(ctx, moderation.Content{Kind: "comment", ID: comment.PublicID, PostID: postPublicID, Body: body})
+	if err != nil {
+		return Comment{}, err
+	}
+	if err := s.insertComment(ctx, postID, comment, verdict); err != nil {
+		return Comment{}, err
+	}
+	comment.Moderation = verdict.Decision
+	return comment, nil
+}
+
+// insertComment inserts the comment with its moderation verdict, increments the cached comment count of its post
+// and notifies the webhooks.
+func (s *Store) insertComment(ctx context.Context, postID int, comment Comment, verdict moderation.Result) error {
+	if _, err := s.db.ExecContext(ctx, s.db.Rebind("INSERT INTO comment (public_id, workspace_id, body, post_id, moderation, moderation_reasons) VALUES (?, ?, ?, ?, ?, ?)"), comment.PublicID, tenant.ID(ctx), comment.Body, postID, verdict.Decision, joinReasons(verdict.Reasons)); err != nil {
+		return err
+	}
+	if err := s.vk.Do(ctx, s.vk.B().Incr().Key(tenant.Key(ctx, fmt.Sprintf("post:%s:comment_count", comment.PostID))).Build()).Error(); err != nil {
+		slog.ErrorContext(ctx, "failed to increment comment count in valkey", slog.Any("error", err))
+	}
+	comment.Moderation = verdict.Decision
+	s.webhooks.Notify(ctx, webhook.EventCommentAdded, comment)
+	return nil
+}
+
+// DeleteComment removes a comment of the post and decrements its cached comment count.
+func (s *Store) DeleteComment(ctx context.Context, postPublicID, commentPublicID string) error {
+	result, err := s.db.ExecContext(ctx, s.db.Rebind("DELETE FROM comment WHERE public_id = ? AND post_id = (SELECT id FROM post WHERE public_id = ? AND workspace_id = ?)"), commentPublicID, postPublicID, tenant.ID(ctx))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrCommentNotFound
+	}
+	if err := s.vk.Do(ctx, s.vk.B().Decr().Key(tenant.Key(ctx, fmt.Sprintf("post:%s:comment_count", postPublicID))).Build()).Error(); err != nil {
+		slog.ErrorContext(ctx, "failed to decrement comment count in valkey", slog.Any("error", err))
+	}
+	return nil
+}
+
+// primaryKey resolves the auto-increment ID of a post of the workspace of ctx, caching it in Valkey.
+func (s *Store) primaryKey(ctx context.Context, publicID string) (int, error) {
+	pkKey := tenant.Key(ctx, fmt.Sprintf("post_pk:%s", publicID))
+	if pkStr, err := s.vk.Do(ctx, s.vk.B().Get().Key(pkKey).Build()).AsBytes(); err == nil {
+		if postID, err := strconv.Atoi(string(pkStr)); err == nil {
+			return postID, nil
+		}
+	}
+	var postID int
+	if err := s.db.GetContext(ctx, &postID, s.db.Rebind("SELECT id FROM post WHERE public_id = ? AND workspace_id = ? AND deleted_at IS NULL"), publicID, tenant.ID(ctx)); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrPostNotFound
+		}
+		return 0, err
+	}
+	if err := s.vk.Do(ctx, s.vk.B().Set().Key(pkKey).Value(strconv.Itoa(postID)).Build()).Error(); err != nil {
+		slog.ErrorContext(ctx, "failed to set post pk in valkey", slog.Any("error", err))
+	}
+	return postID, nil
+}
+
+// reader returns where the reads of ctx go: a replica when the request allows it, or the primary.
+func (s *Store) reader(ctx context.Context) *sqlx.DB {
+	if db := s.replicas.Reader(ctx); db != nil {
+		return db
+	}
+	return s.db
+}
+
+// checkPostQuota returns tenant.ErrQuotaExceeded if n more posts do not fit in the quota of the workspace of ctx.
+// Posts created concurrently are not counted, so the quota can be overrun by a few posts.
+func (s *Store) checkPostQuota(ctx context.Context, n int) error {
+	limit := s.quotas.Of(ctx).MaxPosts
+	if limit == 0 {
+		return nil
+	}
+	total, err := s.TotalCount(ctx)
+	if err != nil {
+		return err
+	}
+	return tenant.Check(limit, total, n)
+}
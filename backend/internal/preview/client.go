@@ -0,0 +1,18 @@
+package preview
+
+import (
+	"net/http"
+
+	"backend/internal/config"
+	"backend/internal/netguard"
+)
+
+// NewClient returns the client fetching pages for previews. Posts choose the URLs it fetches, so it only connects
+// to public addresses unless cfg.AllowPrivate is set, redirects included.
+func NewClient(cfg config.Previews) *http.Client {
+	return &http.Client{
+		Transport:     netguard.NewTransport(cfg.Timeout, cfg.AllowPrivate),
+		Timeout:       cfg.Timeout,
+		CheckRedirect: netguard.CheckRedirect,
+	}
+}
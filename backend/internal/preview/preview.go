@@ -0,0 +1,308 @@
+package preview
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"backend/internal/config"
+	"backend/internal/job"
+	"backend/internal/telemetry"
+
+	"github.com/valkey-io/valkey-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/net/html"
+)
+
+const (
+	// fetchJob fetches the metadata of a URL into the cache. Its payload is the URL.
+	fetchJob = "preview.fetch"
+	// MaxLinks is the number of links of a post that get a preview.
+	MaxLinks = 3
+	// pendingTTL keeps a URL from being enqueued again while its fetch is waiting for a worker.
+	pendingTTL = time.Minute
+	// failureTTL is how long a page without a preview is remembered, which is shorter than the TTL of previews
+	// so that a page that was down is tried again.
+	failureTTL = time.Hour
+
+	maxTitleLength       = 200
+	maxDescriptionLength = 300
+)
+
+// Card is the preview of a link, from the OpenGraph metadata of its page or, failing that, its title.
+type Card struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// link matches the http and https URLs of a text. Trailing punctuation is trimmed by URLs.
+var link = regexp.MustCompile("(?i)\\bhttps?://[^\\s<>\"'`]+")
+
+// URLs returns the first MaxLinks distinct http and https URLs of the text.
+func URLs(text string) []string {
+	var urls []string
+	for _, raw := range link.FindAllString(text, -1) {
+		raw = strings.TrimRight(raw, ".,;:!?)]}")
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" || u.User != nil {
+			continue
+		}
+		u.Scheme = strings.ToLower(u.Scheme)
+		u.Fragment = ""
+		s := u.String()
+		if !slices.Contains(urls, s) {
+			urls = append(urls, s)
+		}
+		if len(urls) == MaxLinks {
+			break
+		}
+	}
+	return urls
+}
+
+// Fetcher fetches link previews from background jobs and caches them in Valkey.
+// The methods of a nil Fetcher do nothing, which is how previews are disabled.
+type Fetcher struct {
+	vk       valkey.Client
+	jobs     *job.Queue
+	client   *http.Client
+	maxBytes int64
+	ttl      time.Duration
+}
+
+// New registers the job of the fetcher on jobs, or returns nil if previews are disabled.
+// client fetches the pages, see NewClient.
+func New(cfg config.Previews, vk valkey.Client, jobs *job.Queue, client *http.Client) *Fetcher {
+	if !cfg.Enabled {
+		return nil
+	}
+	f := &Fetcher{vk: vk, jobs: jobs, client: client, maxBytes: cfg.MaxBytes, ttl: cfg.TTL}
+	jobs.Handle(fetchJob, f.fetch)
+	return f
+}
+
+func cacheKey(u string) string {
+	sum := sha256.Sum256([]byte(u))
+	return "preview:" + hex.EncodeToString(sum[:])
+}
+
+// Cards returns the cached previews of the URLs, keyed by URL, and enqueues the fetch of those not cached.
+// URLs whose page has no preview are left out.
+func (f *Fetcher) Cards(ctx context.Context, urls []string) map[string]Card {
+	cards := make(map[string]Card, len(urls))
+	if f == nil || len(urls) == 0 {
+		return cards
+	}
+	keys := make([]string, len(urls))
+	for i, u := range urls {
+		keys[i] = cacheKey(u)
+	}
+	values, err := f.vk.Do(ctx, f.vk.B().Mget().Key(keys...).Build()).ToArray()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get link previews from valkey", slog.Any("error", err))
+		return cards
+	}
+	for i, v := range values {
+		raw, err := v.ToString()
+		if valkey.IsValkeyNil(err) {
+			f.request(ctx, urls[i])
+			continue
+		}
+		var card Card
+		if err != nil || json.Unmarshal([]byte(raw), &card) != nil {
+			continue
+		}
+		if card.Title != "" {
+			cards[urls[i]] = card
+		}
+	}
+	return cards
+}
+
+// Request enqueues the fetch of the previews of the links in the text that are not cached yet.
+func (f *Fetcher) Request(ctx context.Context, text string) {
+	if f == nil {
+		return
+	}
+	// Cards enqueues the missing previews.
+	f.Cards(ctx, URLs(text))
+}
+
+// request enqueues the fetch of a URL, unless another request already did.
+func (f *Fetcher) request(ctx context.Context, u string) {
+	err := f.vk.Do(ctx, f.vk.B().Set().Key(cacheKey(u)+":pending").Value("1").Nx().Ex(pendingTTL).Build()).Error()
+	if valkey.IsValkeyNil(err) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to lock link preview", slog.Any("error", err))
+		return
+	}
+	if err := f.jobs.Enqueue(ctx, fetchJob, u); err != nil {
+		slog.ErrorContext(ctx, "failed to enqueue link preview", slog.String("url", u), slog.Any("error", err))
+	}
+}
+
+func (f *Fetcher) fetch(ctx context.Context, j job.Job) error {
+	var u string
+	if err := j.Decode(&u); err != nil {
+		return err
+	}
+	card, err := f.scrape(ctx, u)
+	ttl := f.ttl
+	if err != nil {
+		// Pages are not retried, the failure is cached instead so that readers stop asking for them.
+		slog.WarnContext(ctx, "failed to fetch link preview", slog.String("url", u), slog.Any("error", err))
+		card = Card{URL: u}
+		ttl = min(ttl, failureTTL)
+	}
+	raw, err := json.Marshal(card)
+	if err != nil {
+		return err
+	}
+	key := cacheKey(u)
+	for _, res := range f.vk.DoMulti(ctx,
+		f.vk.B().Set().Key(key).Value(string(raw)).Ex(ttl).Build(),
+		f.vk.B().Del().Key(key+":pending").Build(),
+	) {
+		if err := res.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrape fetches the page and reads its metadata.
+func (f *Fetcher) scrape(ctx context.Context, u string) (card Card, err error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "preview.fetch")
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return Card{}, err
+	}
+	span.SetAttributes(attribute.String("preview.host", req.URL.Host))
+	req.Header.Set("User-Agent", "ddfeed-preview/1.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return Card{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Card{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return Card{}, fmt.Errorf("unsupported content type %q", mediaType)
+	}
+	card = parse(io.LimitReader(resp.Body, f.maxBytes), resp.Request.URL)
+	card.URL = u
+	span.SetAttributes(attribute.Bool("preview.found", card.Title != ""))
+	return card, nil
+}
+
+// parse reads the OpenGraph metadata of the head of a page. The title and description meta tags are the fallbacks.
+// base resolves a relative image URL.
+func parse(r io.Reader, base *url.URL) Card {
+	var card Card
+	var title, description string
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		name, hasAttr := z.TagName()
+		tag := string(name)
+		if tt == html.EndTagToken && tag == "head" || tt == html.StartTagToken && tag == "body" {
+			break
+		}
+		if tt == html.StartTagToken && tag == "title" && title == "" {
+			if z.Next() == html.TextToken {
+				title = string(z.Text())
+			}
+			continue
+		}
+		if (tt != html.StartTagToken && tt != html.SelfClosingTagToken) || tag != "meta" || !hasAttr {
+			continue
+		}
+		var property, content string
+		for {
+			key, val, more := z.TagAttr()
+			switch string(key) {
+			case "property", "name":
+				property = strings.ToLower(string(val))
+			case "content":
+				content = string(val)
+			}
+			if !more {
+				break
+			}
+		}
+		switch property {
+		case "og:title":
+			card.Title = content
+		case "og:description":
+			card.Description = content
+		case "og:image":
+			card.Image = content
+		case "og:site_name":
+			card.SiteName = content
+		case "description":
+			description = content
+		}
+	}
+	if card.Title == "" {
+		card.Title = title
+	}
+	if card.Description == "" {
+		card.Description = description
+	}
+	card.Title = truncate(card.Title, maxTitleLength)
+	card.Description = truncate(card.Description, maxDescriptionLength)
+	card.SiteName = truncate(card.SiteName, maxTitleLength)
+	card.Image = resolveImage(base, card.Image)
+	return card
+}
+
+// resolveImage returns the absolute URL of an image, or nothing if it is not an http or https URL.
+func resolveImage(base *url.URL, image string) string {
+	if image == "" {
+		return ""
+	}
+	u, err := base.Parse(strings.TrimSpace(image))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+// truncate collapses the spaces of s and cuts it to n runes.
+func truncate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
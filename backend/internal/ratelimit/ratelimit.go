@@ -0,0 +1,149 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// tokenBucket refills KEYS[1] with ARGV[1] tokens every ARGV[2] milliseconds and takes one token from it.
+// It uses the Valkey clock so that every backend replica agrees on the time.
+// It returns whether the request is allowed, the tokens left, the milliseconds until a token is available
+// and the milliseconds until the bucket is full again.
+var tokenBucket = valkey.NewLuaScript(`
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+local rate = capacity / period
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], period)
+return {allowed, math.floor(tokens), retry, math.ceil((capacity - tokens) / rate)}
+`)
+
+// KeyFunc returns who a request is counted against.
+type KeyFunc func(r *http.Request) string
+
+// ClientIP keys requests by the address of the client.
+// Envoy runs with use_remote_address, so the last X-Forwarded-For entry is the address it saw the client connect from;
+// earlier entries are set by the client and cannot be trusted.
+func ClientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		parts := strings.Split(xff, ",")
+		if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Rule allows Limit requests per Period to each key, in bursts of up to Limit requests.
+type Rule struct {
+	Limit  int
+	Period time.Duration
+	// Key defaults to ClientIP.
+	Key KeyFunc
+}
+
+type Limiter struct {
+	vk valkey.Client
+}
+
+func New(vk valkey.Client) *Limiter {
+	return &Limiter{vk: vk}
+}
+
+type result struct {
+	allowed    bool
+	remaining  int64
+	retryAfter time.Duration
+	reset      time.Duration
+}
+
+func (l *Limiter) take(ctx context.Context, key string, rule Rule) (result, error) {
+	values, err := tokenBucket.Exec(ctx, l.vk, []string{key}, []string{
+		strconv.Itoa(rule.Limit),
+		strconv.FormatInt(rule.Period.Milliseconds(), 10),
+	}).ToArray()
+	if err != nil {
+		return result{}, err
+	}
+	if len(values) != 4 {
+		return result{}, fmt.Errorf("unexpected rate limit script result of length %d", len(values))
+	}
+	var ints [4]int64
+	for i, v := range values {
+		if ints[i], err = v.AsInt64(); err != nil {
+			return result{}, err
+		}
+	}
+	return result{
+		allowed:    ints[0] == 1,
+		remaining:  ints[1],
+		retryAfter: time.Duration(ints[2]) * time.Millisecond,
+		reset:      time.Duration(ints[3]) * time.Millisecond,
+	}, nil
+}
+
+// Limit wraps next so that it answers 429 Too Many Requests once a key goes over the rule.
+// name identifies the bucket, so routes sharing a name share their limits. Buckets are not per workspace, since
+// clients choose their workspace and would get fresh buckets by switching.
+// Requests are let through when Valkey cannot be reached.
+func (l *Limiter) Limit(name string, rule Rule, next http.HandlerFunc) http.HandlerFunc {
+	keyFunc := rule.Key
+	if keyFunc == nil {
+		keyFunc = ClientIP
+	}
+	policy := fmt.Sprintf("%d;w=%d", rule.Limit, int(rule.Period.Seconds()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := fmt.Sprintf("ratelimit:%s:%s", name, keyFunc(r))
+		res, err := l.take(r.Context(), key, rule)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to check rate limit", slog.String("key", key), slog.Any("error", err))
+			next(w, r)
+			return
+		}
+		w.Header().Set("RateLimit-Policy", policy)
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(rule.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.FormatInt(res.remaining, 10))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(res.reset)))
+		if !res.allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(seconds(res.retryAfter)))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// seconds rounds d up to whole seconds, as the headers do not allow fractions.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
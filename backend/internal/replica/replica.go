@@ -0,0 +1,109 @@
+package replica
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"backend/internal/telemetry"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// cookieName marks the clients that wrote recently, and read from the primary until it expires.
+const cookieName = "ddfeed_primary"
+
+type contextKey struct{}
+
+type writeKey struct{}
+
+// write is what ReadOnly needs to take back the mark Wrap set on a client.
+type write struct {
+	header        http.Header
+	wroteRecently bool
+}
+
+// Pool spreads reads over the read replicas of the database.
+// The methods of a nil Pool do nothing, which is how the reads stay on the primary without replicas.
+type Pool struct {
+	replicas       []*sqlx.DB
+	readYourWrites time.Duration
+	next           atomic.Uint64
+}
+
+// New returns nil without replicas. A client reads from the primary for readYourWrites after each of its writes.
+func New(replicas []*sqlx.DB, readYourWrites time.Duration) *Pool {
+	if len(replicas) == 0 {
+		return nil
+	}
+	return &Pool{replicas: replicas, readYourWrites: readYourWrites}
+}
+
+// Wrap lets the reads of the safe requests of next go to a replica, unless the client wrote recently.
+// Other requests mark the client as having written, since they go to the primary and may change what it reads next,
+// unless next finds they only read and calls ReadOnly.
+func (p *Pool) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	if p == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := r.Cookie(cookieName)
+		wroteRecently := err == nil
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookieName,
+				Value:    strconv.FormatInt(time.Now().Unix(), 10),
+				Path:     "/",
+				MaxAge:   max(int(p.readYourWrites.Seconds()), 1),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			ctx := context.WithValue(r.Context(), writeKey{}, &write{header: w.Header(), wroteRecently: wroteRecently})
+			next(w, r.WithContext(ctx))
+			return
+		}
+		next(w, r.WithContext(read(r.Context(), wroteRecently)))
+	}
+}
+
+// ReadOnly lets the reads of the request in ctx go to a replica like those of a GET, for the requests whose method
+// does not tell whether they write, such as GraphQL queries sent with POST. The client is not marked as having
+// written, so it must be called before the response is written.
+func ReadOnly(ctx context.Context) context.Context {
+	wr, ok := ctx.Value(writeKey{}).(*write)
+	if !ok {
+		return ctx
+	}
+	cookies := wr.header.Values("Set-Cookie")
+	wr.header.Del("Set-Cookie")
+	for _, c := range cookies {
+		if !strings.HasPrefix(c, cookieName+"=") {
+			wr.header.Add("Set-Cookie", c)
+		}
+	}
+	return read(ctx, wr.wroteRecently)
+}
+
+// read returns ctx for the reads of a safe request, which go to a replica unless the client wrote recently.
+func read(ctx context.Context, wroteRecently bool) context.Context {
+	if wroteRecently {
+		telemetry.SetTag(ctx, "db.read_your_writes", true)
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, true)
+}
+
+// Reader returns the replica to read from in ctx, or nil if the read must go to the primary.
+// The replicas are taken in turn.
+func (p *Pool) Reader(ctx context.Context) *sqlx.DB {
+	if p == nil {
+		return nil
+	}
+	if ok, _ := ctx.Value(contextKey{}).(bool); !ok {
+		return nil
+	}
+	return p.replicas[(p.next.Add(1)-1)%uint64(len(p.replicas))]
+}
@@ -0,0 +1,226 @@
+package seed
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/tenant"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+	"github.com/valkey-io/valkey-go"
+)
+
+// Options describe the generated dataset.
+type Options struct {
+	Posts int
+	// Distribution of the number of comments per post: zipf, uniform or none.
+	Distribution string
+	MaxComments  int
+	// ZipfS is the exponent of the zipf distribution. Higher values leave more posts without comments.
+	ZipfS float64
+	// Span spreads the creation times of the posts over this duration before now.
+	Span      time.Duration
+	BatchSize int
+	// Authors and Tags add a @handle and #hashtags to the bodies, as the schema has no columns for them.
+	Authors bool
+	Tags    bool
+	// RandomSeed makes the dataset reproducible.
+	RandomSeed uint64
+	// Workspace receives the posts.
+	Workspace string
+}
+
+// RegisterFlags adds the flags of the seed command to fs.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.Posts, "posts", 1000, "number of posts to insert")
+	fs.StringVar(&o.Distribution, "distribution", "zipf", "distribution of comments per post: zipf, uniform or none")
+	fs.IntVar(&o.MaxComments, "max-comments", 200, "maximum number of comments of a post")
+	fs.Float64Var(&o.ZipfS, "zipf-s", 1.3, "exponent of the zipf distribution, greater than 1")
+	fs.DurationVar(&o.Span, "span", 90*24*time.Hour, "spread the posts over this duration before now")
+	fs.IntVar(&o.BatchSize, "batch-size", 500, "rows per INSERT statement")
+	fs.BoolVar(&o.Authors, "authors", false, "start bodies with an author handle")
+	fs.BoolVar(&o.Tags, "tags", false, "end bodies with hashtags")
+	fs.Uint64Var(&o.RandomSeed, "random-seed", uint64(time.Now().UnixNano()), "seed of the random generator")
+	fs.StringVar(&o.Workspace, "workspace", tenant.Default, "workspace to insert the posts in")
+}
+
+func (o Options) validate() error {
+	switch {
+	case o.Posts < 1:
+		return fmt.Errorf("posts must be at least 1")
+	case o.BatchSize < 1:
+		return fmt.Errorf("batch size must be at least 1")
+	case o.MaxComments < 0:
+		return fmt.Errorf("max comments must not be negative")
+	case o.Distribution == "zipf" && o.ZipfS <= 1:
+		return fmt.Errorf("zipf-s must be greater than 1")
+	case o.Distribution != "zipf" && o.Distribution != "uniform" && o.Distribution != "none":
+		return fmt.Errorf("unknown distribution %q", o.Distribution)
+	}
+	return tenant.Validate(o.Workspace)
+}
+
+type seededPost struct {
+	id       int
+	publicID string
+	body     string
+	created  time.Time
+	comments int
+}
+
+// Run inserts the posts and their comments in batches, then warms the Valkey keys the post handlers read.
+func Run(ctx context.Context, db *sqlx.DB, vk valkey.Client, opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	ctx = tenant.With(ctx, opts.Workspace)
+	var seed [32]byte
+	binary.LittleEndian.PutUint64(seed[:], opts.RandomSeed)
+	// ChaCha8 also serves as the entropy of the ULIDs, keeping them reproducible too.
+	src := rand.NewChaCha8(seed)
+	r := rand.New(src)
+	commentCount := commentCounter(r, opts)
+	text := textGenerator{r: r, entropy: src, authors: opts.Authors, tags: opts.Tags}
+	start := time.Now().Add(-opts.Span)
+	step := opts.Span / time.Duration(opts.Posts)
+
+	var posts, comments int
+	for offset := 0; offset < opts.Posts; offset += opts.BatchSize {
+		batch := make([]seededPost, min(opts.BatchSize, opts.Posts-offset))
+		for i := range batch {
+			// Posts are inserted oldest first so that their IDs follow their creation times, as in production.
+			created := start.Add(step * time.Duration(offset+i)).UTC().Truncate(time.Second)
+			batch[i] = seededPost{
+				publicID: ulid.MustNew(ulid.Timestamp(created), src).String(),
+				body:     text.post(),
+				created:  created,
+				comments: commentCount(),
+			}
+		}
+		if err := insertPosts(ctx, db, batch); err != nil {
+			return err
+		}
+		n, err := insertComments(ctx, db, batch, text, opts.BatchSize)
+		if err != nil {
+			return err
+		}
+		if err := warm(ctx, vk, batch); err != nil {
+			return err
+		}
+		posts += len(batch)
+		comments += n
+		slog.InfoContext(ctx, "seeded posts", slog.Int("posts", posts), slog.Int("comments", comments))
+	}
+
+	var total int
+	if err := db.GetContext(ctx, &total, db.Rebind("SELECT COUNT(*) FROM post WHERE workspace_id = ? AND deleted_at IS NULL"), opts.Workspace); err != nil {
+		return err
+	}
+	return vk.Do(ctx, vk.B().Set().Key(tenant.Key(ctx, "post:total_count")).Value(strconv.Itoa(total)).Build()).Error()
+}
+
+func commentCounter(r *rand.Rand, opts Options) func() int {
+	switch {
+	case opts.Distribution == "none" || opts.MaxComments == 0:
+		return func() int { return 0 }
+	case opts.Distribution == "uniform":
+		return func() int { return r.IntN(opts.MaxComments + 1) }
+	default:
+		zipf := rand.NewZipf(r, opts.ZipfS, 1, uint64(opts.MaxComments))
+		return func() int { return int(zipf.Uint64()) }
+	}
+}
+
+func insertPosts(ctx context.Context, db *sqlx.DB, batch []seededPost) error {
+	placeholders := make([]string, len(batch))
+	args := make([]any, 0, len(batch)*4)
+	publicIDs := make([]string, len(batch))
+	for i, p := range batch {
+		placeholders[i] = "(?, ?, ?, ?)"
+		args = append(args, p.publicID, tenant.ID(ctx), p.body, p.created)
+		publicIDs[i] = p.publicID
+	}
+	if _, err := db.ExecContext(ctx, db.Rebind("INSERT INTO post (public_id, workspace_id, body, created_at) VALUES "+strings.Join(placeholders, ", ")), args...); err != nil {
+		return fmt.Errorf("insert posts: %w", err)
+	}
+	// Auto-increment IDs of a multi-row insert are not guaranteed to be consecutive, so read them back.
+	query, args, err := sqlx.In("SELECT id, public_id FROM post WHERE public_id IN (?)", publicIDs)
+	if err != nil {
+		return err
+	}
+	var rows []struct {
+		ID       int    `db:"id"`
+		PublicID string `db:"public_id"`
+	}
+	if err := db.SelectContext(ctx, &rows, db.Rebind(query), args...); err != nil {
+		return fmt.Errorf("select post ids: %w", err)
+	}
+	ids := make(map[string]int, len(rows))
+	for _, row := range rows {
+		ids[row.PublicID] = row.ID
+	}
+	for i := range batch {
+		batch[i].id = ids[batch[i].publicID]
+	}
+	return nil
+}
+
+func insertComments(ctx context.Context, db *sqlx.DB, posts []seededPost, text textGenerator, batchSize int) (int, error) {
+	var placeholders []string
+	var args []any
+	var inserted int
+	flush := func() error {
+		if len(placeholders) == 0 {
+			return nil
+		}
+		if _, err := db.ExecContext(ctx, db.Rebind("INSERT INTO comment (public_id, workspace_id, body, post_id, created_at) VALUES "+strings.Join(placeholders, ", ")), args...); err != nil {
+			return fmt.Errorf("insert comments: %w", err)
+		}
+		inserted += len(placeholders)
+		placeholders, args = placeholders[:0], args[:0]
+		return nil
+	}
+	for _, p := range posts {
+		for range p.comments {
+			// Comments arrive within a week of their post.
+			created := p.created.Add(time.Duration(text.r.Int64N(int64(7 * 24 * time.Hour)))).Truncate(time.Second)
+			if created.After(time.Now()) {
+				created = time.Now().UTC().Truncate(time.Second)
+			}
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+			args = append(args, ulid.MustNew(ulid.Timestamp(created), text.entropy).String(), tenant.ID(ctx), text.comment(), p.id, created)
+			if len(placeholders) == batchSize {
+				if err := flush(); err != nil {
+					return inserted, err
+				}
+			}
+		}
+	}
+	return inserted, flush()
+}
+
+// warm sets the keys that post.Store would have set had the posts been created through the API.
+func warm(ctx context.Context, vk valkey.Client, batch []seededPost) error {
+	cmds := make(valkey.Commands, 0, len(batch)*3)
+	for _, p := range batch {
+		cmds = append(cmds,
+			vk.B().Set().Key(tenant.Key(ctx, "post:"+p.publicID)).Value(p.body).Build(),
+			vk.B().Set().Key(tenant.Key(ctx, "post_pk:"+p.publicID)).Value(strconv.Itoa(p.id)).Build(),
+			vk.B().Set().Key(tenant.Key(ctx, "post:"+p.publicID+":comment_count")).Value(strconv.Itoa(p.comments)).Build(),
+		)
+	}
+	for _, res := range vk.DoMulti(ctx, cmds...) {
+		if err := res.Error(); err != nil {
+			return fmt.Errorf("warm valkey: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package seed
+
+import (
+	"io"
+	"math/rand/v2"
+	"strings"
+)
+
+var (
+	words = strings.Fields(`
+		the a an of to and in is it that for on with as was at by this be from or have not are but
+		deploy latency query index cache replica trace span service database table schema cluster
+		dashboard monitor alert incident outage release rollout pipeline build test review merge
+		coffee weekend team lunch morning afternoon meeting idea plan project launch customer
+		finally really quite pretty almost never always today yesterday tomorrow again still
+		slow fast broken fixed noisy quiet flaky stable new old big small weird great better worse
+		think know feel guess found saw made tried shipped wrote read learned broke measured`)
+	handles = []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi", "ivan", "judy", "mallory", "oscar", "peggy", "trent", "victor", "walter"}
+	tags    = []string{"golang", "mysql", "valkey", "observability", "dbm", "apm", "sre", "devops", "performance", "oncall", "opentelemetry", "datadog"}
+)
+
+// textGenerator writes short posts and comments out of a fixed vocabulary.
+type textGenerator struct {
+	r       *rand.Rand
+	entropy io.Reader
+	authors bool
+	tags    bool
+}
+
+func (g textGenerator) sentence() string {
+	n := 4 + g.r.IntN(14)
+	sentence := make([]string, n)
+	for i := range sentence {
+		sentence[i] = words[g.r.IntN(len(words))]
+	}
+	sentence[0] = strings.ToUpper(sentence[0][:1]) + sentence[0][1:]
+	return strings.Join(sentence, " ") + [...]string{".", ".", ".", "!", "?"}[g.r.IntN(5)]
+}
+
+func (g textGenerator) post() string {
+	var sb strings.Builder
+	if g.authors {
+		sb.WriteString("@" + handles[g.r.IntN(len(handles))] + ": ")
+	}
+	for i := range 1 + g.r.IntN(3) {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(g.sentence())
+	}
+	if g.tags {
+		for range g.r.IntN(3) {
+			sb.WriteString(" #" + tags[g.r.IntN(len(tags))])
+		}
+	}
+	return sb.String()
+}
+
+func (g textGenerator) comment() string {
+	if g.authors {
+		return "@" + handles[g.r.IntN(len(handles))] + ": " + g.sentence()
+	}
+	return g.sentence()
+}
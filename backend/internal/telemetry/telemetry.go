@@ -0,0 +1,65 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "backend"
+
+// Tracer returns the tracer used for spans that are not covered by automatic instrumentation.
+// Both cmd/dd and cmd/otel install a global OpenTelemetry tracer provider, so spans started
+// from it end up in the same trace as the HTTP, SQL and Valkey spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Inject serializes the span context of ctx so that it can travel with a message.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// Extract returns a copy of ctx carrying the remote span context serialized by Inject.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// Tagger sets a tag on the span of ctx in a tracing library other than OpenTelemetry.
+type Tagger func(ctx context.Context, key string, value any)
+
+var taggers []Tagger
+
+// AddTagger makes SetTag also call tagger. It must be called before serving requests.
+// cmd/dd uses it so that tags land on the spans created by orchestrion, which the OpenTelemetry API does not see.
+func AddTagger(tagger Tagger) {
+	taggers = append(taggers, tagger)
+}
+
+// SetTag sets a tag on the current span.
+func SetTag(ctx context.Context, key string, value any) {
+	var attr attribute.KeyValue
+	switch v := value.(type) {
+	case bool:
+		attr = attribute.Bool(key, v)
+	case int:
+		attr = attribute.Int(key, v)
+	case string:
+		attr = attribute.String(key, v)
+	default:
+		attr = attribute.String(key, fmt.Sprint(v))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attr)
+	for _, tagger := range taggers {
+		tagger(ctx, key, value)
+	}
+}
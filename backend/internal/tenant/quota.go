@@ -0,0 +1,39 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+
+	"backend/internal/config"
+)
+
+var ErrQuotaExceeded = errors.New("workspace quota exceeded")
+
+// Quotas are the limits of the workspaces. A nil Quotas limits nothing.
+type Quotas struct {
+	quota  config.Quota
+	quotas map[string]config.Quota
+}
+
+func NewQuotas(cfg config.Workspaces) *Quotas {
+	return &Quotas{quota: cfg.Quota, quotas: cfg.Quotas}
+}
+
+// Of returns the quota of the workspace of ctx. Its zero limits are unlimited.
+func (q *Quotas) Of(ctx context.Context) config.Quota {
+	if q == nil {
+		return config.Quota{}
+	}
+	if quota, ok := q.quotas[ID(ctx)]; ok {
+		return quota
+	}
+	return q.quota
+}
+
+// Check returns ErrQuotaExceeded if adding n to the current count goes over limit. A limit of 0 is unlimited.
+func Check(limit, current, n int) error {
+	if limit > 0 && current+n > limit {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"backend/internal/config"
+	"backend/internal/telemetry"
+)
+
+// Default is the workspace of requests that name none, and of the rows written before workspaces existed.
+const Default = "default"
+
+// Tag is the span tag and log attribute holding the workspace.
+const Tag = "workspace.id"
+
+var ErrInvalidWorkspace = errors.New("invalid workspace")
+
+// valid are the workspace IDs, which must also be valid DNS labels to be used as subdomains.
+var valid = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]{0,30}[a-z0-9])?$`)
+
+type contextKey struct{}
+
+// With returns a copy of ctx in the workspace.
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the workspace of ctx, if one was set.
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+	return id, ok
+}
+
+// ID returns the workspace of ctx, or Default.
+func ID(ctx context.Context) string {
+	if id, ok := FromContext(ctx); ok {
+		return id
+	}
+	return Default
+}
+
+// Key namespaces a Valkey key in the workspace of ctx, so that counters such as post:total_count are per workspace.
+func Key(ctx context.Context, key string) string {
+	return "ws:" + ID(ctx) + ":" + key
+}
+
+// Validate returns ErrInvalidWorkspace unless id can name a workspace.
+func Validate(id string) error {
+	if !valid.MatchString(id) {
+		return fmt.Errorf("%w %q", ErrInvalidWorkspace, id)
+	}
+	return nil
+}
+
+// Resolver finds the workspace of a request.
+type Resolver struct {
+	header     string
+	baseDomain string
+}
+
+func NewResolver(cfg config.Workspaces) *Resolver {
+	return &Resolver{header: cfg.Header, baseDomain: strings.ToLower(strings.Trim(cfg.BaseDomain, "."))}
+}
+
+// Resolve returns the workspace named by the header, or else by the subdomain of the base domain the request was
+// sent to, or else Default.
+func (r *Resolver) Resolve(req *http.Request) (string, error) {
+	if r.header != "" {
+		if id := req.Header.Get(r.header); id != "" {
+			id = strings.ToLower(strings.TrimSpace(id))
+			return id, Validate(id)
+		}
+	}
+	if r.baseDomain != "" {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if sub, ok := strings.CutSuffix(host, "."+r.baseDomain); ok {
+			// Only the label right before the base domain names the workspace.
+			if i := strings.LastIndexByte(sub, '.'); i >= 0 {
+				sub = sub[i+1:]
+			}
+			return sub, Validate(sub)
+		}
+	}
+	return Default, nil
+}
+
+// Wrap runs next in the workspace of the request, which is tagged on its span. Requests naming an invalid
+// workspace get 400 Bad Request.
+func (r *Resolver) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, err := r.Resolve(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx := With(req.Context(), id)
+		telemetry.SetTag(ctx, Tag, id)
+		next(w, req.WithContext(ctx))
+	}
+}
+
+// LogHandler adds the workspace of the context to the records it passes to the wrapped handler.
+type LogHandler struct {
+	slog.Handler
+}
+
+func NewLogHandler(h slog.Handler) *LogHandler {
+	return &LogHandler{Handler: h}
+}
+
+func (h *LogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := FromContext(ctx); ok {
+		record.AddAttrs(slog.String(Tag, id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithGroup(name)}
+}
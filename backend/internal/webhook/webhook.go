@@ -0,0 +1,315 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/config"
+	"backend/internal/job"
+	"backend/internal/netguard"
+	"backend/internal/tenant"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// Events a webhook can subscribe to.
+const (
+	EventPostCreated  = "post.created"
+	EventPostDeleted  = "post.deleted"
+	EventCommentAdded = "comment.added"
+)
+
+var Events = []string{EventPostCreated, EventPostDeleted, EventCommentAdded}
+
+const (
+	// dispatchJob fans an event out to the webhooks subscribed to it.
+	dispatchJob = "webhook.dispatch"
+	// deliverJob sends an event to one webhook. The job queue retries it until the endpoint answers 2xx.
+	deliverJob = "webhook.deliver"
+
+	deliveryTimeout = 10 * time.Second
+)
+
+var (
+	ErrWebhookNotFound = errors.New("no webhook found")
+	ErrInvalidWebhook  = errors.New("invalid webhook")
+)
+
+// Webhook is an endpoint receiving the events it subscribed to.
+type Webhook struct {
+	ID        int       `db:"id" json:"-"`
+	PublicID  string    `db:"public_id" json:"id"`
+	URL       string    `db:"url" json:"url"`
+	RawEvents string    `db:"events" json:"-"`
+	Events    []string  `db:"-" json:"events"`
+	Secret    string    `db:"secret" json:"secret,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Delivery is an attempt at sending an event to a webhook.
+type Delivery struct {
+	DeliveryID string    `db:"delivery_id" json:"delivery_id"`
+	Event      string    `db:"event" json:"event"`
+	Attempt    int       `db:"attempt" json:"attempt"`
+	StatusCode *int      `db:"status_code" json:"status_code,omitempty"`
+	Error      *string   `db:"error" json:"error,omitempty"`
+	DurationMS int       `db:"duration_ms" json:"duration_ms"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+// Payload is the JSON body posted to webhooks.
+type Payload struct {
+	ID         string          `json:"id"`
+	Event      string          `json:"event"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+type dispatchPayload struct {
+	Event      string          `json:"event"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+type deliverPayload struct {
+	WebhookID int     `json:"webhook_id"`
+	Payload   Payload `json:"payload"`
+}
+
+// Dispatcher delivers feed events to the registered webhooks from background jobs.
+// Every request is signed with the secret of its webhook, see Sign.
+type Dispatcher struct {
+	db     *sqlx.DB
+	jobs   *job.Queue
+	client *http.Client
+	quotas *tenant.Quotas
+}
+
+// NewDispatcher registers the jobs of the dispatcher on jobs. client sends the events, and quotas limit the webhooks
+// of each workspace.
+func NewDispatcher(db *sqlx.DB, jobs *job.Queue, client *http.Client, quotas *tenant.Quotas) *Dispatcher {
+	d := &Dispatcher{db: db, jobs: jobs, client: client, quotas: quotas}
+	jobs.Handle(dispatchJob, d.dispatch)
+	jobs.Handle(deliverJob, d.deliver)
+	return d
+}
+
+// NewClient returns the client delivering webhooks. Workspaces choose the URLs it posts to, so it only connects to
+// public addresses unless cfg.AllowPrivate is set, and does not follow redirects, which answer as failed deliveries.
+func NewClient(cfg config.Webhooks) *http.Client {
+	return &http.Client{
+		Transport: netguard.NewTransport(deliveryTimeout, cfg.AllowPrivate),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Notify enqueues the delivery of an event. It is a no-op on a nil Dispatcher, and failures are only logged
+// so that webhooks never fail the change they report.
+func (d *Dispatcher) Notify(ctx context.Context, event string, data any) {
+	if d == nil {
+		return
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to encode webhook event", slog.String("event", event), slog.Any("error", err))
+		return
+	}
+	if err := d.jobs.Enqueue(ctx, dispatchJob, dispatchPayload{Event: event, OccurredAt: time.Now().UTC(), Data: raw}); err != nil {
+		slog.ErrorContext(ctx, "failed to enqueue webhook event", slog.String("event", event), slog.Any("error", err))
+	}
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context, j job.Job) error {
+	var p dispatchPayload
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+	// The job runs in the workspace the event happened in, whose webhooks receive it.
+	var webhooks []Webhook
+	if err := d.db.SelectContext(ctx, &webhooks, d.db.Rebind("SELECT id, events FROM webhook WHERE workspace_id = ?"), tenant.ID(ctx)); err != nil {
+		return err
+	}
+	for _, w := range webhooks {
+		if !slices.Contains(strings.Split(w.RawEvents, ","), p.Event) {
+			continue
+		}
+		// The delivery ID is derived from the job ID, so that dispatching again after a failure does not
+		// send an event twice under different IDs.
+		payload := Payload{ID: j.ID + "-" + strconv.Itoa(w.ID), Event: p.Event, OccurredAt: p.OccurredAt, Data: p.Data}
+		if err := d.jobs.Enqueue(ctx, deliverJob, deliverPayload{WebhookID: w.ID, Payload: payload}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, j job.Job) error {
+	var p deliverPayload
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+	var w Webhook
+	if err := d.db.GetContext(ctx, &w, d.db.Rebind("SELECT id, url, secret FROM webhook WHERE id = ?"), p.WebhookID); err != nil {
+		if err == sql.ErrNoRows {
+			// Deleted since the event was dispatched.
+			return nil
+		}
+		return err
+	}
+	body, err := json.Marshal(p.Payload)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	statusCode, err := d.send(ctx, w, p.Payload, body)
+	delivery := Delivery{
+		DeliveryID: p.Payload.ID,
+		Event:      p.Payload.Event,
+		Attempt:    j.Attempt,
+		DurationMS: int(time.Since(start).Milliseconds()),
+	}
+	if statusCode != 0 {
+		delivery.StatusCode = &statusCode
+	}
+	if err != nil {
+		msg := err.Error()
+		delivery.Error = &msg
+	}
+	if _, logErr := d.db.ExecContext(ctx, d.db.Rebind("INSERT INTO webhook_delivery (webhook_id, delivery_id, event, attempt, status_code, error, duration_ms) VALUES (?, ?, ?, ?, ?, ?, ?)"),
+		w.ID, delivery.DeliveryID, delivery.Event, delivery.Attempt, delivery.StatusCode, delivery.Error, delivery.DurationMS); logErr != nil {
+		slog.ErrorContext(ctx, "failed to log webhook delivery", slog.Any("error", logErr))
+	}
+	return err
+}
+
+func (d *Dispatcher) send(ctx context.Context, w Webhook, p Payload, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Ddfeed-Event", p.Event)
+	req.Header.Set("X-Ddfeed-Delivery", p.ID)
+	req.Header.Set("X-Ddfeed-Signature", fmt.Sprintf("t=%d,v1=%s", timestamp, Sign(w.Secret, timestamp, body)))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" with the secret of a webhook.
+// Receivers recompute it from the t and v1 values of the X-Ddfeed-Signature header, and should reject old timestamps
+// to prevent replays.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Create registers a webhook in the workspace of ctx and returns it with its secret, which is not shown again.
+// It returns tenant.ErrQuotaExceeded if the workspace has all the webhooks it may have.
+func (d *Dispatcher) Create(ctx context.Context, rawURL string, events []string) (Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidWebhook)
+	}
+	if len(events) == 0 {
+		return Webhook{}, fmt.Errorf("%w: events must not be empty", ErrInvalidWebhook)
+	}
+	for _, e := range events {
+		if !slices.Contains(Events, e) {
+			return Webhook{}, fmt.Errorf("%w: unknown event %q, must be one of %s", ErrInvalidWebhook, e, strings.Join(Events, ", "))
+		}
+	}
+	if limit := d.quotas.Of(ctx).MaxWebhooks; limit > 0 {
+		var count int
+		if err := d.db.GetContext(ctx, &count, d.db.Rebind("SELECT COUNT(*) FROM webhook WHERE workspace_id = ?"), tenant.ID(ctx)); err != nil {
+			return Webhook{}, err
+		}
+		if err := tenant.Check(limit, count, 1); err != nil {
+			return Webhook{}, err
+		}
+	}
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	w := Webhook{
+		PublicID:  ulid.Make().String(),
+		URL:       rawURL,
+		Events:    events,
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if _, err := d.db.ExecContext(ctx, d.db.Rebind("INSERT INTO webhook (public_id, workspace_id, url, events, secret, created_at) VALUES (?, ?, ?, ?, ?, ?)"), w.PublicID, tenant.ID(ctx), w.URL, strings.Join(w.Events, ","), w.Secret, w.CreatedAt); err != nil {
+		return Webhook{}, err
+	}
+	return w, nil
+}
+
+// List returns the webhooks of the workspace of ctx without their secrets.
+func (d *Dispatcher) List(ctx context.Context) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	if err := d.db.SelectContext(ctx, &webhooks, d.db.Rebind("SELECT public_id, url, events, created_at FROM webhook WHERE workspace_id = ? ORDER BY id"), tenant.ID(ctx)); err != nil {
+		return nil, err
+	}
+	for i := range webhooks {
+		webhooks[i].Events = strings.Split(webhooks[i].RawEvents, ",")
+	}
+	return webhooks, nil
+}
+
+// Delete removes a webhook and its delivery log. Deliveries in flight are dropped.
+func (d *Dispatcher) Delete(ctx context.Context, publicID string) error {
+	result, err := d.db.ExecContext(ctx, d.db.Rebind("DELETE FROM webhook WHERE public_id = ? AND workspace_id = ?"), publicID, tenant.ID(ctx))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Deliveries returns the last delivery attempts of a webhook, most recent first.
+func (d *Dispatcher) Deliveries(ctx context.Context, publicID string, limit int) ([]Delivery, error) {
+	var id int
+	if err := d.db.GetContext(ctx, &id, d.db.Rebind("SELECT id FROM webhook WHERE public_id = ? AND workspace_id = ?"), publicID, tenant.ID(ctx)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	deliveries := []Delivery{}
+	if err := d.db.SelectContext(ctx, &deliveries, d.db.Rebind("SELECT delivery_id, event, attempt, status_code, error, duration_ms, created_at FROM webhook_delivery WHERE webhook_id = ? ORDER BY id DESC LIMIT ?"), id, limit); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
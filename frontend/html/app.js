@@ -6,42 +6,53 @@ const elements = {
     postsList: document.getElementById('posts-list'),
     addPostForm: document.getElementById('add-post-form'),
     postBodyInput: document.getElementById('post-body'),
+    postAttachmentsInput: document.getElementById('post-attachments'),
+    postAttachmentsList: document.getElementById('post-attachments-list'),
     postDetail: document.getElementById('post-detail'),
     postContent: document.getElementById('post-content'),
     commentsList: document.getElementById('comments-list'),
     addCommentForm: document.getElementById('add-comment-form'),
     commentBodyInput: document.getElementById('comment-body'),
+    typingIndicator: document.getElementById('typing-indicator'),
     pagination: document.getElementById('pagination')
 };
 
 // State
 let currentPostID = null;
-let lastIDStack = [null]; // Stack supports back/prev navigation for cursor-based pagination
-let currentLastID = null;
-let nextLastID = null;
+let currentCursor = null; // Opaque cursor of the current page, null for the first page
+let nextCursor = null;
+let prevCursor = null;
+let currentSort = 'newest';
 const postsPerPage = 10;
+let liveSocket = null;
+let typingTimer = null;
+let lastTypingSentAt = 0;
 
 // API Functions
 const api = {
-    async getPosts(page = 1, limit = postsPerPage) {
-        // Kept for possible future use, but the UI uses cursor-based pagination
-        const response = await fetch(`${API_BASE}/posts?page=${page}&limit=${limit}`);
-        if (!response.ok) throw new Error('Failed to fetch posts');
-        return response.json();
-    },
-
     async getPostDetail(id) {
-        const response = await fetch(`${API_BASE}/posts/${id}`);
+        const response = await fetch(`${API_BASE}/posts/${id}`, { credentials: 'include' });
         if (!response.ok) throw new Error('Failed to fetch post details');
         return response.json();
     },
 
-    async createPost(body) {
-        const response = await fetch(`${API_BASE}/posts`, {
+    async createPost(body, files = []) {
+        let request = {
             method: 'POST',
+            credentials: 'include',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify({ body })
-        });
+        };
+        if (files.length > 0) {
+            // Attachments go in a multipart form, the browser sets its Content-Type
+            const form = new FormData();
+            form.append('body', body);
+            files.forEach(file => form.append('attachments', file));
+            request = { method: 'POST', credentials: 'include', body: form };
+        }
+        const response = await fetch(`${API_BASE}/posts`, request);
+        // Moderation rejections and oversized attachments come with their reasons
+        if (response.status === 422 || response.status === 413) throw new Error(await response.text());
         if (!response.ok) throw new Error('Failed to create post');
         return response.json();
     },
@@ -49,15 +60,33 @@ const api = {
     async createComment(postID, body) {
         const response = await fetch(`${API_BASE}/posts/${postID}/comment`, {
             method: 'POST',
+            credentials: 'include',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify({ body })
         });
+        // Moderation rejections come with their reasons
+        if (response.status === 422) throw new Error(await response.text());
         if (!response.ok) throw new Error('Failed to create comment');
-        return response.json();
+        const comment = await response.json();
+        // With async_comments on, the comment is accepted with 202 and persisted by a job, so wait for it
+        if (response.status === 202) return api.waitForComment(postID, comment.id);
+        return comment;
+    },
+
+    async waitForComment(postID, commentID) {
+        for (let attempt = 0; attempt < 20; attempt++) {
+            await new Promise(resolve => setTimeout(resolve, 500));
+            const response = await fetch(`${API_BASE}/posts/${postID}/comment/${commentID}`, { credentials: 'include' });
+            if (!response.ok) throw new Error('Failed to fetch comment status');
+            const status = await response.json();
+            if (status.state === 'rejected') throw new Error(`Comment rejected: ${status.reason}`);
+            if (status.state === 'accepted') return status;
+        }
+        throw new Error('Comment is still pending');
     },
 
     async deletePost(id) {
-        const response = await fetch(`${API_BASE}/posts/${id}`, { method: 'DELETE' });
+        const response = await fetch(`${API_BASE}/posts/${id}`, { method: 'DELETE', credentials: 'include' });
         if (!response.ok) throw new Error('Failed to delete post');
     }
 };
@@ -83,7 +112,8 @@ const ui = {
         }
         div.innerHTML = `
             <div class="post-content">
-                <div class="post-body-text">${post.body}</div>
+                <div class="post-body-text">${ui.bodyHTML(post)}${ui.editedLabel(post)}</div>
+                ${ui.previewCards(post)}
                 <div class="post-meta">
                     <span class="post-actions">
                         <button class="view ${commentClass}" onclick="(() => showPostDetail('${post.id}'))()">${commentLabel}</button>
@@ -101,19 +131,92 @@ const ui = {
         // Always update modal content to ensure fresh data after comment creation
         elements.postContent.innerHTML = `
             <div class="post-detail-content">
-                <p id="post-body-text">${post.body}</p>
+                <div id="post-body-text">${ui.bodyHTML(post)}${ui.editedLabel(post)}</div>
+                ${ui.previewCards(post)}
             </div>
         `;
 
+        elements.postAttachmentsList.innerHTML = '';
+        (post.attachments || []).forEach(attachment => ui.appendAttachment(attachment));
+
         elements.commentsList.innerHTML = '';
         if (post.comments?.length > 0) {
-            post.comments.forEach(comment => {
-                const li = document.createElement('li');
-                li.className = 'comment-item';
-                li.innerHTML = `<p>${comment.body}</p>`;
-                elements.commentsList.appendChild(li);
-            });
+            post.comments.forEach(comment => ui.appendComment(comment));
+        }
+    },
+
+    bodyHTML(post) {
+        // The backend renders the Markdown body to sanitised HTML; the raw body is only ever shown as text
+        if (post.rendered_html) return post.rendered_html;
+        const div = document.createElement('div');
+        div.textContent = post.body;
+        return div.innerHTML;
+    },
+
+    previewCards(post) {
+        // Previews are fetched in the background, so a new post gets them on a later load
+        if (!post.previews?.length) return '';
+        const escape = text => {
+            const span = document.createElement('span');
+            span.textContent = text || '';
+            return span.innerHTML.replaceAll('"', '&quot;');
+        };
+        return post.previews.map(card => `
+            <a class="preview-card" href="${escape(card.url)}" target="_blank" rel="noopener noreferrer">
+                ${card.image ? `<img src="${escape(card.image)}" alt="" loading="lazy">` : ''}
+                <span class="preview-text">
+                    <strong>${escape(card.title)}</strong>
+                    ${card.description ? `<span>${escape(card.description)}</span>` : ''}
+                    <small>${escape(card.site_name || new URL(card.url).host)}</small>
+                </span>
+            </a>
+        `).join('');
+    },
+
+    editedLabel(post) {
+        if (!post.edited_at) return '';
+        return ` <span class="edited" title="Edited ${new Date(post.edited_at).toLocaleString()}">(edited)</span>`;
+    },
+
+    appendAttachment(attachment) {
+        // Download URLs are signed by the backend and relative to it
+        const link = document.createElement('a');
+        link.className = 'attachment-item';
+        link.href = new URL(attachment.url, API_BASE).href;
+        link.target = '_blank';
+        if (attachment.thumbnail_url) {
+            const img = document.createElement('img');
+            img.src = new URL(attachment.thumbnail_url, API_BASE).href;
+            img.alt = attachment.filename;
+            link.appendChild(img);
+        } else {
+            link.textContent = attachment.filename;
         }
+        elements.postAttachmentsList.appendChild(link);
+    },
+
+    appendComment(comment) {
+        // Live events may race with the refetch after posting a comment, so skip duplicates
+        if (elements.commentsList.querySelector(`[data-id="${comment.id}"]`)) return;
+        const li = document.createElement('li');
+        li.className = 'comment-item';
+        li.dataset.id = comment.id;
+        // Comments are plain text, never HTML
+        const p = document.createElement('p');
+        p.textContent = comment.body;
+        li.appendChild(p);
+        elements.commentsList.appendChild(li);
+    },
+
+    removeComment(id) {
+        elements.commentsList.querySelector(`[data-id="${id}"]`)?.remove();
+    },
+
+    showTyping() {
+        // Hide the indicator shortly after the last typing event
+        elements.typingIndicator.classList.remove('hidden');
+        clearTimeout(typingTimer);
+        typingTimer = setTimeout(() => elements.typingIndicator.classList.add('hidden'), 3000);
     },
 
     showModal() {
@@ -130,6 +233,7 @@ const ui = {
         document.body.classList.remove('modal-open');
         document.body.style.overflow = '';
         currentPostID = null;
+        live.disconnect();
         history.pushState({ type: 'page' }, '', '/posts');
     },
 
@@ -149,23 +253,39 @@ const ui = {
         const div = document.createElement('div');
         div.className = 'pagination';
         
-        // Previous button is disabled on the first page (stack length 1)
+        // Previous button is disabled when the backend returns no prev_cursor
         const prevButton = document.createElement('button');
         prevButton.textContent = '←';
-        prevButton.className = lastIDStack.length <= 1 ? 'disabled' : '';
+        prevButton.className = !prevCursor ? 'disabled' : '';
         prevButton.onclick = () => {
-            if (lastIDStack.length > 1) goToPrevPage();
+            if (prevCursor) goToPrevPage();
         };
         
-        // Next button is disabled if there are no more posts (see fetchPosts for logic)
+        // Next button is disabled when the backend reports no more posts
         const nextButton = document.createElement('button');
         nextButton.textContent = '→';
-        nextButton.className = !nextLastID ? 'disabled' : '';
+        nextButton.className = !nextCursor ? 'disabled' : '';
         nextButton.onclick = () => {
-            if (nextLastID) goToNextPage();
+            if (nextCursor) goToNextPage();
+        };
+
+        // Changing the order starts over from the first page
+        const sortSelect = document.createElement('select');
+        [['newest', 'Newest'], ['oldest', 'Oldest'], ['most_commented', 'Most commented']].forEach(([value, label]) => {
+            const option = document.createElement('option');
+            option.value = value;
+            option.textContent = label;
+            option.selected = value === currentSort;
+            sortSelect.appendChild(option);
+        });
+        sortSelect.onchange = () => {
+            currentSort = sortSelect.value;
+            currentCursor = null;
+            fetchPosts();
         };
         
         div.appendChild(prevButton);
+        div.appendChild(sortSelect);
         div.appendChild(nextButton);
         
         elements.pagination.innerHTML = '';
@@ -173,39 +293,79 @@ const ui = {
     }
 };
 
+// Live comments of the open post
+const live = {
+    connect(postID) {
+        if (liveSocket && liveSocket.postID === postID && liveSocket.readyState <= WebSocket.OPEN) return;
+        live.disconnect();
+        const socket = new WebSocket(`${API_BASE.replace(/^http/, 'ws')}/posts/${postID}/live`);
+        socket.postID = postID;
+        socket.onmessage = (message) => {
+            const event = JSON.parse(message.data);
+            if (event.post_id !== currentPostID) return;
+            switch (event.type) {
+                case 'comment.added':
+                    ui.appendComment(event.data);
+                    break;
+                case 'comment.deleted':
+                    ui.removeComment(event.data.id);
+                    break;
+                case 'typing':
+                    ui.showTyping();
+                    break;
+                case 'post.updated':
+                    document.getElementById('post-body-text').innerHTML = `${ui.bodyHTML(event.data)}${ui.editedLabel(event.data)}`;
+                    break;
+                case 'post.deleted':
+                    ui.hideModal();
+                    fetchPosts();
+                    break;
+            }
+        };
+        liveSocket = socket;
+    },
+
+    disconnect() {
+        if (liveSocket) {
+            liveSocket.close();
+            liveSocket = null;
+        }
+        elements.typingIndicator.classList.add('hidden');
+    },
+
+    sendTyping() {
+        // Throttle typing notifications to one every two seconds
+        const now = Date.now();
+        if (!liveSocket || liveSocket.readyState !== WebSocket.OPEN || now - lastTypingSentAt < 2000) return;
+        lastTypingSentAt = now;
+        liveSocket.send(JSON.stringify({ type: 'typing' }));
+    }
+};
+
 // Event Handlers
 async function fetchPosts(suppressUrlUpdate = false) {
     const params = new URLSearchParams();
     params.append('limit', postsPerPage);
-    if (currentLastID) params.append('last_id', currentLastID);
+    if (currentCursor) {
+        params.append('cursor', currentCursor);
+    } else {
+        params.append('sort', currentSort);
+    }
 
-    const response = await fetch(`${API_BASE}/posts?${params.toString()}`);
+    const response = await fetch(`${API_BASE}/posts?${params.toString()}`, { credentials: 'include' });
     const data = await response.json();
 
     elements.postsList.innerHTML = '';
-    let posts = [];
     if (Array.isArray(data.posts)) {
-        posts = data.posts;
         data.posts.forEach(post => {
             elements.postsList.appendChild(ui.createPostElement(post));
         });
     }
 
-    // Peek ahead to ensure the next button is only enabled if the next page has posts
-    if (posts.length === postsPerPage && data.next_last_id) {
-        const peekParams = new URLSearchParams();
-        peekParams.append('limit', postsPerPage);
-        peekParams.append('last_id', data.next_last_id);
-        const peekResponse = await fetch(`${API_BASE}/posts?${peekParams.toString()}`);
-        const peekData = await peekResponse.json();
-        if (Array.isArray(peekData.posts) && peekData.posts.length > 0) {
-            nextLastID = data.next_last_id;
-        } else {
-            nextLastID = null;
-        }
-    } else {
-        nextLastID = null;
-    }
+    // The backend fetches one extra post to tell whether a next page exists
+    currentSort = data.sort || currentSort;
+    nextCursor = data.has_more ? data.next_cursor : null;
+    prevCursor = data.prev_cursor || null;
     ui.createPaginationControls();
     if (!suppressUrlUpdate) {
         updateUrlForPage();
@@ -219,6 +379,7 @@ async function showPostDetail(id) {
         ui.updatePostDetail(post);
         ui.resetCommentForm();
         ui.showModal();
+        live.connect(id);
         const expectedPath = `/posts/${id}`;
         if (window.location.pathname !== expectedPath) {
             updateUrlForPostDetail(id);
@@ -262,14 +423,17 @@ elements.addPostForm.addEventListener('submit', async (event) => {
     const body = elements.postBodyInput.value.trim();
     if (!body) return;
     try {
-        await api.createPost(body);
+        await api.createPost(body, Array.from(elements.postAttachmentsInput.files));
         elements.postBodyInput.value = '';
+        elements.postAttachmentsInput.value = '';
         await fetchPosts();
     } catch (error) {
-        ui.showError('Failed to create post');
+        ui.showError(error.message);
     }
 });
 
+elements.commentBodyInput.addEventListener('input', () => live.sendTyping());
+
 elements.addCommentForm.addEventListener('submit', async (event) => {
     event.preventDefault();
     const body = elements.commentBodyInput.value.trim();
@@ -280,7 +444,7 @@ elements.addCommentForm.addEventListener('submit', async (event) => {
         await showPostDetail(currentPostID);
         await fetchPosts();
     } catch (error) {
-        ui.showError('Failed to add comment');
+        ui.showError(error.message);
     }
 });
 
@@ -290,27 +454,25 @@ window.deletePost = deletePost;
 // Pagination controls
 function goToNextPage() {
     // Block navigation if there is no next page, to prevent empty page views
-    if (!nextLastID) return;
-    lastIDStack.push(nextLastID);
-    currentLastID = nextLastID;
+    if (!nextCursor) return;
+    currentCursor = nextCursor;
     fetchPosts();
 }
 
 function goToPrevPage() {
-    // Only allow going back if there is a previous page in the stack
-    if (lastIDStack.length > 1) {
-        lastIDStack.pop();
-        currentLastID = lastIDStack[lastIDStack.length - 1];
-        fetchPosts();
-    }
+    // The previous page is fetched backward from the first post of the current page
+    if (!prevCursor) return;
+    currentCursor = prevCursor;
+    fetchPosts();
 }
 
 function updateUrlForPage() {
     // Always update the URL to reflect the current pagination state for shareability and navigation
     const params = new URLSearchParams();
     params.append('limit', postsPerPage);
-    if (currentLastID) params.append('last_id', currentLastID);
-    history.pushState({ type: 'page', lastID: currentLastID }, '', `?${params.toString()}`);
+    params.append('sort', currentSort);
+    if (currentCursor) params.append('cursor', currentCursor);
+    history.pushState({ type: 'page', cursor: currentCursor }, '', `?${params.toString()}`);
 }
 
 function updateUrlForPostDetail(postID) {
@@ -319,36 +481,10 @@ function updateUrlForPostDetail(postID) {
     history.pushState({ type: 'post', postID }, '', `/posts/${postID}${search}`);
 }
 
-// Helper: Find and load the page containing a specific post ID
-async function loadPageContainingPost(postID) {
-    // Find the correct page for a post so the background list matches the detail
-    let lastID = null;
-    let found = false;
-    let pagePosts = [];
-    let pageStack = [null];
-    while (!found) {
-        const params = new URLSearchParams();
-        params.append('limit', postsPerPage);
-        if (lastID) params.append('last_id', lastID);
-        const response = await fetch(`${API_BASE}/posts?${params.toString()}`);
-        const data = await response.json();
-        if (!Array.isArray(data.posts) || data.posts.length === 0) break;
-        pagePosts = data.posts;
-        if (pagePosts.some(post => post.id === postID)) {
-            found = true;
-            break;
-        }
-        if (!data.next_last_id) break;
-        lastID = data.next_last_id;
-        pageStack.push(lastID);
-    }
-    if (found) {
-        lastIDStack = [...pageStack];
-        currentLastID = lastIDStack[lastIDStack.length - 1];
-    } else {
-        lastIDStack = [null];
-        currentLastID = null;
-    }
+// Helper: Restore the pagination state from the query string
+function restorePageFromParams(params) {
+    currentCursor = params.get('cursor');
+    currentSort = params.get('sort') || 'newest';
 }
 
 function restoreFromUrl() {
@@ -363,19 +499,11 @@ function restoreFromUrl() {
     if (path.startsWith('/posts/') && /^\/posts\/[A-Za-z0-9]+$/.test(path)) {
         // When accessing a post detail, ensure the background list is the correct page
         const postID = path.split('/')[2];
-        const params = new URLSearchParams(search);
-        const lastID = params.get('last_id');
-        currentLastID = lastID;
-        lastIDStack = [null];
-        if (lastID) lastIDStack.push(lastID);
+        restorePageFromParams(new URLSearchParams(search));
         fetchPosts(true).then(() => showPostDetail(postID));
     } else {
         // For pagination, restore the correct page from the URL
-        const params = new URLSearchParams(search);
-        const lastID = params.get('last_id');
-        currentLastID = lastID;
-        lastIDStack = [null];
-        if (lastID) lastIDStack.push(lastID);
+        restorePageFromParams(new URLSearchParams(search));
         fetchPosts();
     }
 }
@@ -6,22 +6,83 @@ USE \`ddfeed\`;
 CREATE TABLE IF NOT EXISTS post (
     id INT AUTO_INCREMENT PRIMARY KEY,
     public_id CHAR(26) NOT NULL,
+    workspace_id VARCHAR(32) NOT NULL DEFAULT 'default',
     body TEXT,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-    UNIQUE KEY idx_post_public_id (public_id)
+    updated_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+    edited_at TIMESTAMP NULL DEFAULT NULL,
+    deleted_at TIMESTAMP NULL DEFAULT NULL,
+    moderation VARCHAR(8) NOT NULL DEFAULT 'allow',
+    moderation_reasons TEXT NULL,
+    UNIQUE KEY idx_post_public_id (public_id),
+    INDEX idx_post_deleted_at (deleted_at),
+    INDEX idx_post_workspace_id (workspace_id, deleted_at, id),
+    INDEX idx_post_moderation (moderation)
 );
 CREATE TABLE IF NOT EXISTS comment (
     id INT AUTO_INCREMENT PRIMARY KEY,
     public_id CHAR(26) NOT NULL,
+    workspace_id VARCHAR(32) NOT NULL DEFAULT 'default',
     body TEXT,
     post_id INT,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    moderation VARCHAR(8) NOT NULL DEFAULT 'allow',
+    moderation_reasons TEXT NULL,
     FOREIGN KEY (post_id) REFERENCES post(id) ON DELETE CASCADE,
     INDEX idx_comment_post_id (post_id),
+    INDEX idx_comment_moderation (moderation),
+    INDEX idx_comment_workspace_id (workspace_id),
     UNIQUE KEY idx_comment_public_id (public_id)
 );
+CREATE TABLE IF NOT EXISTS post_revision (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    post_id INT NOT NULL,
+    revision INT NOT NULL,
+    body TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (post_id) REFERENCES post(id) ON DELETE CASCADE,
+    UNIQUE KEY idx_post_revision_post_id_revision (post_id, revision)
+);
+CREATE TABLE IF NOT EXISTS attachment (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    public_id CHAR(26) NOT NULL,
+    post_id INT NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    blob_key VARCHAR(255) NOT NULL,
+    thumbnail_key VARCHAR(255) NULL,
+    width INT NULL,
+    height INT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (post_id) REFERENCES post(id) ON DELETE CASCADE,
+    UNIQUE KEY idx_attachment_public_id (public_id)
+);
+CREATE TABLE IF NOT EXISTS webhook (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    public_id CHAR(26) NOT NULL,
+    workspace_id VARCHAR(32) NOT NULL DEFAULT 'default',
+    url VARCHAR(2048) NOT NULL,
+    events VARCHAR(255) NOT NULL,
+    secret CHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY idx_webhook_public_id (public_id),
+    INDEX idx_webhook_workspace_id (workspace_id)
+);
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    webhook_id INT NOT NULL,
+    delivery_id VARCHAR(40) NOT NULL,
+    event VARCHAR(32) NOT NULL,
+    attempt INT NOT NULL,
+    status_code INT NULL,
+    error TEXT NULL,
+    duration_ms INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (webhook_id) REFERENCES webhook(id) ON DELETE CASCADE,
+    INDEX idx_webhook_delivery_webhook_id (webhook_id, id)
+);
 "
 mysql -u root -p'password' -e "\
 GRANT REPLICATION CLIENT ON *.* TO 'datadog'@'%';
@@ -55,6 +116,11 @@ END $$
 DELIMITER ;
 GRANT EXECUTE ON PROCEDURE ddfeed.explain_statement TO 'datadog'@'%';
 "
+# The replica of docker-compose.yaml connects as this user, see replica.sh.
+mysql -u root -p'password' -e "
+CREATE USER IF NOT EXISTS 'replication'@'%' IDENTIFIED BY 'replication';
+GRANT REPLICATION SLAVE, REPLICATION CLIENT ON *.* TO 'replication'@'%';
+"
 # https://docs.datadoghq.com/database_monitoring/setup_mysql/troubleshooting/#events-waits-current-not-enabled
 mysql -u root -p'password' -e "\
 CREATE USER IF NOT EXISTS 'backend'@'%' IDENTIFIED BY 'password';\
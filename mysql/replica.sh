@@ -0,0 +1,15 @@
+#!/bin/bash -ex
+
+# init.sh already created the schema and the users here, so the replica follows the primary from where it is now
+# rather than replaying its initialization.
+until mysqladmin ping -h mysql -u replication -p'replication' --silent; do
+    sleep 1
+done
+gtid_executed=$(mysql -h mysql -u replication -p'replication' -N -e "SELECT REPLACE(@@GLOBAL.gtid_executed, '\n', '')")
+if [ -n "$gtid_executed" ]; then
+    mysql -u root -p'password' -e "SET GLOBAL gtid_purged = '+${gtid_executed}';"
+fi
+mysql -u root -p'password' -e "
+CHANGE REPLICATION SOURCE TO SOURCE_HOST='mysql', SOURCE_USER='replication', SOURCE_PASSWORD='replication', SOURCE_AUTO_POSITION=1, GET_SOURCE_PUBLIC_KEY=1;
+START REPLICA;
+"
@@ -0,0 +1,30 @@
+-- Runs once in the ddfeed database, which the backend owns and migrates.
+-- https://docs.datadoghq.com/database_monitoring/setup_postgres/selfhosted/
+CREATE USER datadog WITH PASSWORD 'datadog';
+GRANT pg_monitor TO datadog;
+CREATE SCHEMA datadog;
+GRANT USAGE ON SCHEMA datadog TO datadog;
+GRANT USAGE ON SCHEMA public TO datadog;
+CREATE EXTENSION IF NOT EXISTS pg_stat_statements SCHEMA public;
+
+-- https://docs.datadoghq.com/database_monitoring/setup_postgres/selfhosted/#create-the-explain-function
+CREATE OR REPLACE FUNCTION datadog.explain_statement(
+   l_query TEXT,
+   OUT explain JSON
+)
+RETURNS SETOF JSON AS
+$$
+DECLARE
+curs REFCURSOR;
+plan JSON;
+
+BEGIN
+   OPEN curs FOR EXECUTE pg_catalog.concat('EXPLAIN (FORMAT JSON) ', l_query);
+   FETCH curs INTO plan;
+   CLOSE curs;
+   RETURN QUERY SELECT plan;
+END;
+$$
+LANGUAGE 'plpgsql'
+RETURNS NULL ON NULL INPUT
+SECURITY DEFINER;